@@ -1,17 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
 const VERSION = "2.0"
@@ -21,6 +34,13 @@ var (
 	cache   = filepath.Join(home, ".ssh", "ssh-forge.json")
 	key     = filepath.Join(home, ".ssh", "id_ed25519")
 
+	settingsFile = filepath.Join(home, ".ssh", "ssh-forge.toml")
+	exportFile   = filepath.Join(home, ".ssh", "config.d", "ssh-forge.conf")
+	tunnelDir    = filepath.Join(home, ".ssh", "ssh-forge-tunnels")
+	knownHosts   = filepath.Join(home, ".ssh", "known_hosts")
+	recordDir    = filepath.Join(home, ".ssh", "ssh-forge-recordings")
+	startLog     = filepath.Join(home, ".ssh", "ssh-forge-start.log")
+
 	GREEN  = "\033[32m"
 	RED    = "\033[31m"
 	YELLOW = "\033[33m"
@@ -28,247 +48,4311 @@ var (
 	NC     = "\033[0m"
 )
 
-type Entry struct {
-	User string `json:"user"`
-	Host string `json:"host"`
-	Port int    `json:"port"`
-}
+type Entry struct {
+	User     string   `json:"user"`
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Alias    string   `json:"alias,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Identity string   `json:"identity,omitempty"`
+	Jump     []string `json:"jump,omitempty"`
+	Note     string   `json:"note,omitempty"`
+	HostKey  string   `json:"host_key,omitempty"`
+
+	// Ephemeral hosts (short-lived VMs) have their host key refreshed
+	// instead of blocked when it changes. With TTL (seconds) they are
+	// dropped once unused for that long.
+	Ephemeral bool  `json:"ephemeral,omitempty"`
+	TTL       int64 `json:"ttl,omitempty"`
+
+	// StartCmd brings a powered-off host up (virsh start, a QEMU launch
+	// script, docker start …); StopCmd is what --stop runs.
+	StartCmd string `json:"start_cmd,omitempty"`
+	StopCmd  string `json:"stop_cmd,omitempty"`
+
+	// MAC enables Wake-on-LAN; WakeAddr is the broadcast host[:port] the
+	// magic packet goes to (255.255.255.255:9 when empty).
+	MAC      string `json:"mac,omitempty"`
+	WakeAddr string `json:"wake_addr,omitempty"`
+
+	// Command and Dir shape interactive sessions: start in Dir and run
+	// Command (e.g. "tmux new -A -s main") instead of the login shell.
+	Command string `json:"command,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+
+	FirstSeen int64 `json:"first_seen,omitempty"`
+	LastUsed  int64 `json:"last_used,omitempty"`
+	Uses      int   `json:"uses,omitempty"`
+	DeadSince int64 `json:"dead_since,omitempty"`
+
+	Tunnels map[string]Forward `json:"tunnels,omitempty"`
+}
+
+// Forward is a saved port-forward: Kind is L (local), R (remote) or
+// D (dynamic/SOCKS), Spec is what follows -L/-R/-D on the ssh command line.
+type Forward struct {
+	Kind string `json:"kind"`
+	Spec string `json:"spec"`
+}
+
+func (f Forward) String() string { return f.Kind + " " + f.Spec }
+
+var nameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func die(msg string) {
+	fmt.Println(RED + "❌ " + msg + NC)
+	os.Exit(1)
+}
+func ok(msg string)   { fmt.Println(GREEN + "✅ " + msg + NC) }
+func warn(msg string) { fmt.Println(YELLOW + "⚠️ " + msg + NC) }
+func info(msg string) { fmt.Println(BLUE + "ℹ️ " + msg + NC) }
+
+func need(cmd string) {
+	if _, err := exec.LookPath(cmd); err != nil {
+		die(cmd + " not installed")
+	}
+}
+
+func initSSH() {
+	os.MkdirAll(filepath.Join(home, ".ssh"), 0700)
+	os.Chmod(filepath.Join(home, ".ssh"), 0700)
+
+	need("ssh")
+
+	upgradeCache()
+	pruneExpired()
+
+	if _, err := os.Stat(key); os.IsNotExist(err) {
+		info("Generating SSH key...")
+		cmd := exec.Command("ssh-keygen", "-t", "ed25519", "-f", key, "-N", "")
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			die("Keygen failed")
+		}
+	}
+
+	if _, err := os.Stat(key + ".pub"); err != nil {
+		die("Public key missing")
+	}
+
+	os.Chmod(key, 0600)
+	ok("Key permission fixed (600)")
+}
+
+// settings holds ~/.ssh/ssh-forge.toml: flat `key = value` lines, the subset
+// of TOML ssh-forge needs. Section headers and comments are ignored.
+var settings map[string]string
+
+func loadSettings() map[string]string {
+	if settings != nil {
+		return settings
+	}
+	settings = make(map[string]string)
+
+	data, err := os.ReadFile(settingsFile)
+	if err != nil {
+		return settings
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		k, v, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if strings.HasPrefix(v, `"`) {
+			if end := strings.Index(v[1:], `"`); end >= 0 {
+				v = v[1 : end+1]
+			}
+		} else if i := strings.Index(v, "#"); i >= 0 {
+			v = strings.TrimSpace(v[:i])
+		}
+		settings[strings.TrimSpace(k)] = v
+	}
+	return settings
+}
+
+func setting(name, def string) string {
+	if v, found := loadSettings()[name]; found && v != "" {
+		return v
+	}
+	return def
+}
+
+// saveSetting rewrites name in the settings file, keeping everything else.
+func saveSetting(name, value string) {
+	data, _ := os.ReadFile(settingsFile)
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = []string{"# ssh-forge user settings"}
+	}
+
+	line := fmt.Sprintf("%s = %q", name, value)
+	replaced := false
+	for i, l := range lines {
+		if k, _, found := strings.Cut(l, "="); found && strings.TrimSpace(k) == name {
+			lines[i] = line
+			replaced = true
+		}
+	}
+	if !replaced {
+		lines = append(lines, line)
+	}
+
+	if err := os.WriteFile(settingsFile, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		die("Failed to write " + settingsFile)
+	}
+	loadSettings()[name] = value
+}
+
+// cacheVersion is the schema written by saveCache. The v2.0 releases wrote a
+// bare map keyed by user@host:port, which reads as version 0.
+const cacheVersion = 1
+
+// lockTimeout bounds how long a writer waits for another ssh-forge process.
+const lockTimeout = 10 * time.Second
+
+type cacheFile struct {
+	Version int     `json:"version"`
+	Hosts   []Entry `json:"hosts"`
+}
+
+// migrations[v] upgrades raw cache JSON from schema v to v+1.
+var migrations = map[int]func([]byte) ([]byte, error){
+	0: migrateMapToV1,
+}
+
+func migrateMapToV1(data []byte) ([]byte, error) {
+	var m map[string]Entry
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	f := cacheFile{Version: 1, Hosts: []Entry{}}
+	for _, k := range sortedKeys(m, "") {
+		f.Hosts = append(f.Hosts, m[k])
+	}
+	return json.Marshal(f)
+}
+
+// decodeCache reads any known schema and returns the hosts keyed by
+// user@host:port together with the schema version found on disk.
+func decodeCache(data []byte) (map[string]Entry, int, error) {
+	var probe struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, 0, err
+	}
+
+	version := 0
+	if probe.Version != nil {
+		version = *probe.Version
+	}
+	if version > cacheVersion {
+		return nil, version, fmt.Errorf("schema v%d is newer than this ssh-forge supports (v%d)", version, cacheVersion)
+	}
+
+	for v := version; v < cacheVersion; v++ {
+		var err error
+		if data, err = migrations[v](data); err != nil {
+			return nil, version, fmt.Errorf("migrating schema v%d: %w", v, err)
+		}
+	}
+
+	var f cacheFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, version, err
+	}
+
+	m := make(map[string]Entry, len(f.Hosts))
+	for _, e := range f.Hosts {
+		m[entryKey(e.User, e.Host, e.Port)] = e
+	}
+	return m, version, nil
+}
+
+// backupCache copies the cache aside before it is migrated or reset.
+// The suffix avoids *.bak, which sf-reset deletes.
+func backupCache() string {
+	data, err := os.ReadFile(cache)
+	if err != nil {
+		die("Cannot back up cache: " + err.Error())
+	}
+	backup := cache + ".backup-" + time.Now().Format("20060102-150405")
+	for n := 1; ; n++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.backup-%s-%d", cache, time.Now().Format("20060102-150405"), n)
+	}
+	if err := os.WriteFile(backup, data, 0600); err != nil {
+		die("Cannot back up cache: " + err.Error())
+	}
+	return backup
+}
+
+// upgradeCache migrates an old cache to the current schema and resets a
+// corrupt one, writing a timestamped backup first in both cases.
+func upgradeCache() {
+	// Fast path without the lock: most runs find a current, valid cache.
+	if data, err := os.ReadFile(cache); err == nil {
+		if _, version, err := decodeCache(data); err == nil && version == cacheVersion {
+			return
+		}
+	}
+
+	unlock := lockCache()
+	defer unlock()
+
+	data, err := os.ReadFile(cache)
+	if os.IsNotExist(err) {
+		saveCache(map[string]Entry{})
+		return
+	}
+	if err != nil {
+		die("Cannot read cache: " + err.Error())
+	}
+
+	m, version, err := decodeCache(data)
+	if version > cacheVersion {
+		die("Cache " + err.Error())
+	}
+	if err != nil {
+		backup := backupCache()
+		warn("Cache corrupted (" + err.Error() + ") — saved to " + backup + " and reset")
+		saveCache(map[string]Entry{})
+		return
+	}
+
+	if version < cacheVersion {
+		backup := backupCache()
+		info(fmt.Sprintf("Migrating cache schema v%d → v%d (backup: %s)", version, cacheVersion, backup))
+		saveCache(m)
+	}
+}
+
+// expiresAt is when an ephemeral entry with a TTL runs out, or 0.
+func expiresAt(e Entry) int64 {
+	if !e.Ephemeral || e.TTL <= 0 {
+		return 0
+	}
+	last := e.LastUsed
+	if last == 0 {
+		last = e.FirstSeen
+	}
+	if last == 0 {
+		// Never used and no first-seen time: nothing to count from.
+		return 0
+	}
+	return last + e.TTL
+}
+
+// pruneExpired drops ephemeral entries whose TTL has run out, together
+// with their known_hosts lines.
+func pruneExpired() {
+	now := time.Now().Unix()
+	expired := func(e Entry) bool { t := expiresAt(e); return t != 0 && t <= now }
+
+	// Fast path without the lock, like upgradeCache.
+	due := false
+	for _, e := range loadCache() {
+		if expired(e) {
+			due = true
+			break
+		}
+	}
+	if !due {
+		return
+	}
+
+	var gone []Entry
+	updateCache(func(m map[string]Entry) bool {
+		for k, e := range m {
+			if expired(e) {
+				gone = append(gone, e)
+				delete(m, k)
+			}
+		}
+		return len(gone) > 0
+	})
+	for _, e := range gone {
+		forgetKnownHost(e.Host, e.Port)
+		info("Expired ephemeral host removed: " + entryLine(entryKey(e.User, e.Host, e.Port), e))
+	}
+}
+
+// parseTTL accepts Go durations plus a "d" suffix for days ("7d", "12h").
+func parseTTL(s string) (int64, error) {
+	if days, found := strings.CutSuffix(s, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		return int64(n) * 86400, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid TTL %q (use e.g. 30m, 12h or 7d)", s)
+	}
+	return int64(d.Seconds()), nil
+}
+
+// lockCache takes the advisory lock that serialises cache writers (GUI tabs,
+// terminals, scripts). It waits up to lockTimeout, then gives up loudly.
+func lockCache() func() {
+	f, err := os.OpenFile(cache+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		die("Cannot open cache lock: " + err.Error())
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	waiting := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			die("Cannot lock cache: " + err.Error())
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			die(fmt.Sprintf("Cache still locked after %s — another ssh-forge is writing %s. Retry shortly.", lockTimeout, cache))
+		}
+		if !waiting {
+			info("Cache is locked by another ssh-forge — waiting…")
+			waiting = true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}
+}
+
+// updateCache runs fn on a freshly loaded cache while holding the lock and
+// saves the result when fn reports a change. Never call it from inside fn.
+func updateCache(fn func(m map[string]Entry) bool) {
+	unlock := lockCache()
+	defer unlock()
+
+	m := loadCache()
+	if fn(m) {
+		saveCache(m)
+	}
+}
+
+func loadCache() map[string]Entry {
+	data, err := os.ReadFile(cache)
+	if os.IsNotExist(err) {
+		return make(map[string]Entry)
+	}
+	if err != nil {
+		die("Cannot read cache: " + err.Error())
+	}
+
+	m, _, err := decodeCache(data)
+	if err != nil {
+		die("Cache unreadable: " + err.Error())
+	}
+	return m
+}
+
+func saveCache(m map[string]Entry) {
+	f := cacheFile{Version: cacheVersion, Hosts: []Entry{}}
+	for _, k := range sortedKeys(m, "") {
+		f.Hosts = append(f.Hosts, m[k])
+	}
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		die("Failed to marshal cache")
+	}
+
+	if err := writeFileSync(cache, data, 0644); err != nil {
+		die("Failed to write cache: " + err.Error())
+	}
+
+	if setting("auto_export", "false") == "true" {
+		if err := exportSSHConfig(m, exportFile); err != nil {
+			warn("Auto-export failed: " + err.Error())
+		}
+	}
+}
+
+// writeFileSync replaces path atomically: a uniquely named temp file in the
+// same directory is fsynced, renamed over path, and the directory synced.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func entryKey(user, host string, port int) string {
+	return fmt.Sprintf("%s@%s:%d", user, host, port)
+}
+
+// findAlias returns the cache key of the entry carrying alias.
+// Two entries sharing one alias is a conflict and is never guessed at.
+func findAlias(m map[string]Entry, alias string) (string, bool) {
+	var found []string
+	for k, e := range m {
+		if e.Alias == alias {
+			found = append(found, k)
+		}
+	}
+	if len(found) > 1 {
+		sort.Strings(found)
+		die("Alias conflict: '" + alias + "' is used by " + strings.Join(found, ", "))
+	}
+	if len(found) == 0 {
+		return "", false
+	}
+	return found[0], true
+}
+
+// reservedNames are subcommands; an alias with one of these names could
+// never be reached.
+var reservedNames = map[string]bool{"help": true, "version": true, "tunnel": true}
+
+func checkAlias(alias string) string {
+	if !nameRe.MatchString(alias) {
+		die("Invalid alias '" + alias + "'. Use letters, digits, '.', '_' or '-'")
+	}
+	if reservedNames[alias] {
+		die("'" + alias + "' is a subcommand and cannot be used as an alias")
+	}
+	return alias
+}
+
+func checkTag(tag string) string {
+	if !nameRe.MatchString(tag) {
+		die("Invalid tag '" + tag + "'. Use letters, digits, '.', '_' or '-'")
+	}
+	return tag
+}
+
+func hasTag(e Entry, tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList turns "a, b,,c" into [a b c].
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// flagValue returns the argument following name in args, or "" if name is absent.
+func flagValue(args []string, name string) string {
+	for i, a := range args {
+		if a == name {
+			if i+1 >= len(args) {
+				die(name + " requires a value")
+			}
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// hasFlag reports whether any of names appears in args.
+func hasFlag(args []string, names ...string) bool {
+	for _, a := range args {
+		for _, n := range names {
+			if a == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the cache keys in stable order, limited to tag when set.
+func sortedKeys(m map[string]Entry, tag string) []string {
+	keys := make([]string, 0, len(m))
+	for k, e := range m {
+		if tag == "" || hasTag(e, tag) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func entryLine(k string, e Entry) string {
+	line := k
+	if e.Alias != "" {
+		line += "  (" + e.Alias + ")"
+	}
+	return line
+}
+
+// parseTarget parses the literal user@ip:port / user@[ipv6]:port forms.
+func parseTarget(input string) (Entry, bool) {
+	ipv6 := regexp.MustCompile(`^([^@]+)@\[(.+)\]:(\d+)$`)
+	ipv4 := regexp.MustCompile(`^([^@]+)@([^:]+):(\d+)$`)
+
+	if m := ipv6.FindStringSubmatch(input); m != nil {
+		p, err := strconv.Atoi(m[3])
+		if err != nil {
+			die("Invalid port number")
+		}
+		return Entry{User: m[1], Host: m[2], Port: p}, true
+	}
+	if m := ipv4.FindStringSubmatch(input); m != nil {
+		p, err := strconv.Atoi(m[3])
+		if err != nil {
+			die("Invalid port number")
+		}
+		return Entry{User: m[1], Host: m[2], Port: p}, true
+	}
+	return Entry{}, false
+}
+
+// parse resolves a command-line target. An alias wins over a bare hostname
+// of the same name, and a cached key is taken as is (hosts cached before
+// validation existed may not pass it); everything else goes through
+// parseHost.
+func parse(input string) Entry {
+	if strings.HasPrefix(input, "-") {
+		die("Unknown option: " + input)
+	}
+	m := loadCache()
+	if nameRe.MatchString(input) {
+		if k, found := findAlias(m, input); found {
+			return m[k]
+		}
+	}
+	if e, found := m[input]; found {
+		return e
+	}
+	if t, isTarget := parseTarget(input); isTarget {
+		if e, found := m[entryKey(t.User, t.Host, t.Port)]; found {
+			return e
+		}
+	}
+
+	e, err := parseHost(input)
+	if err != nil {
+		die("Invalid target " + input + ": " + err.Error())
+	}
+	return e
+}
+
+// parseHost accepts host, user@host, host:port, user@host:port, [ipv6]:port
+// and ssh://user@host:port. Missing parts come from the default_user and
+// default_port settings.
+func parseHost(input string) (Entry, error) {
+	s := input
+	if scheme, rest, found := strings.Cut(s, "://"); found {
+		if scheme != "ssh" {
+			return Entry{}, fmt.Errorf("unsupported scheme %q (only ssh:// is accepted)", scheme)
+		}
+		s = strings.TrimSuffix(rest, "/")
+		if strings.Contains(s, "/") {
+			return Entry{}, fmt.Errorf("unexpected path in URI")
+		}
+	}
+
+	u, hostPort := "", s
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		u, hostPort = s[:i], s[i+1:]
+		if u == "" {
+			return Entry{}, fmt.Errorf("empty user name before @")
+		}
+		if strings.ContainsAny(u, " \t@:/") {
+			return Entry{}, fmt.Errorf("invalid user name %q", u)
+		}
+	}
+
+	h, p := hostPort, ""
+	switch {
+	case strings.HasPrefix(hostPort, "["):
+		end := strings.Index(hostPort, "]")
+		if end < 0 {
+			return Entry{}, fmt.Errorf("missing ] after IPv6 address")
+		}
+		h, p = hostPort[1:end], hostPort[end+1:]
+		if p != "" {
+			if !strings.HasPrefix(p, ":") {
+				return Entry{}, fmt.Errorf("unexpected %q after ]", p)
+			}
+			if p = p[1:]; p == "" {
+				return Entry{}, fmt.Errorf("empty port after :")
+			}
+		}
+		if ip, _, _ := strings.Cut(h, "%"); net.ParseIP(ip) == nil || !strings.Contains(ip, ":") {
+			return Entry{}, fmt.Errorf("invalid IPv6 address %q", h)
+		}
+	case strings.Count(hostPort, ":") > 1 && u != "":
+		// user@::1:22 could be ::1 port 22 or ::1:22 port default.
+		return Entry{}, fmt.Errorf("ambiguous IPv6 target %q (write it as user@[addr]:port)", s)
+	case strings.Count(hostPort, ":") == 1:
+		h, p, _ = strings.Cut(hostPort, ":")
+		if p == "" {
+			return Entry{}, fmt.Errorf("empty port after :")
+		}
+	}
+
+	if err := checkHost(h); err != nil {
+		return Entry{}, err
+	}
+
+	port := defaultPort()
+	if p != "" {
+		var err error
+		if port, err = checkPort(p); err != nil {
+			return Entry{}, err
+		}
+	}
+	if u == "" {
+		u = setting("default_user", localUser())
+	}
+	if u == "" {
+		return Entry{}, fmt.Errorf("no user given and no default_user set")
+	}
+	return Entry{User: u, Host: h, Port: port}, nil
+}
+
+func checkPort(p string) (int, error) {
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, fmt.Errorf("port %q is not a number", p)
+	}
+	if n < 1 || n > 65535 {
+		return 0, fmt.Errorf("port %d is out of range (1-65535)", n)
+	}
+	return n, nil
+}
+
+func defaultPort() int {
+	p := setting("default_port", "22")
+	n, err := checkPort(p)
+	if err != nil {
+		die("Invalid default_port in " + settingsFile + ": " + err.Error())
+	}
+	return n
+}
+
+var ipv4Like = regexp.MustCompile(`^[0-9.]+$`)
+
+// checkHost accepts an IP address or an RFC 1123 hostname.
+func checkHost(h string) error {
+	if h == "" {
+		return fmt.Errorf("missing host")
+	}
+	if ip, _, _ := strings.Cut(h, "%"); net.ParseIP(ip) != nil {
+		return nil
+	}
+	if strings.Contains(h, ":") {
+		return fmt.Errorf("invalid IPv6 address %q (write it as [addr]:port)", h)
+	}
+	if ipv4Like.MatchString(h) {
+		return fmt.Errorf("invalid IPv4 address %q", h)
+	}
+	if len(h) > 253 {
+		return fmt.Errorf("hostname is longer than 253 characters")
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(h, "."), ".") {
+		switch {
+		case label == "":
+			return fmt.Errorf("hostname %q has an empty label", h)
+		case len(label) > 63:
+			return fmt.Errorf("label %q in %q is longer than 63 characters", label, h)
+		case label[0] == '-' || label[len(label)-1] == '-':
+			return fmt.Errorf("label %q in %q starts or ends with a hyphen", label, h)
+		}
+		for _, r := range label {
+			if !(r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+				return fmt.Errorf("hostname %q contains invalid character %q", h, r)
+			}
+		}
+	}
+	return nil
+}
+
+// checkIdentity expands and validates a --key path; the matching .pub must
+// exist too because it is what gets installed on first connect.
+func checkIdentity(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(home, path[2:])
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		die("Invalid key path: " + path)
+	}
+	if fi, err := os.Stat(abs); err != nil || fi.IsDir() {
+		die("Private key not found: " + abs)
+	}
+	if _, err := os.Stat(abs + ".pub"); err != nil {
+		die("Public key missing: " + abs + ".pub")
+	}
+	return abs
+}
+
+// keyFor returns the private key used for e: its own identity or the global key.
+func keyFor(e Entry) string {
+	if e.Identity != "" {
+		return e.Identity
+	}
+	return key
+}
+
+// hopRef renders a hop as user@host:port, bracketing IPv6 literals so the
+// reference parses back with parseTarget.
+func hopRef(user, host string, port int) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return fmt.Sprintf("%s@%s:%d", user, host, port)
+}
+
+// jumpRef normalises a --jump element: aliases are kept as written, any
+// other form is stored as its full user@host:port reference.
+func jumpRef(m map[string]Entry, ref string) string {
+	if _, found := findAlias(m, ref); found {
+		return ref
+	}
+	hop, err := parseHost(ref)
+	if err != nil {
+		die("Invalid jump host " + ref + ": " + err.Error())
+	}
+	return hopRef(hop.User, hop.Host, hop.Port)
+}
+
+// resolveJumps resolves e.Jump into the hops to traverse, outermost first.
+// A reference is an alias, a cache key or a raw user@ip:port; cached hops
+// that have their own jump list are expanded in place.
+func resolveJumps(m map[string]Entry, e Entry) ([]Entry, error) {
+	var hops []Entry
+	var walk func(refs []string, seen map[string]bool) error
+	walk = func(refs []string, seen map[string]bool) error {
+		for _, ref := range refs {
+			hop, isTarget := parseTarget(ref)
+			if isTarget {
+				if cached, found := m[entryKey(hop.User, hop.Host, hop.Port)]; found {
+					hop = cached
+				}
+			} else {
+				k, found := findAlias(m, ref)
+				if !found {
+					return fmt.Errorf("unknown jump host: %s", ref)
+				}
+				hop = m[k]
+			}
+
+			k := entryKey(hop.User, hop.Host, hop.Port)
+			if seen[k] {
+				return fmt.Errorf("jump loop detected at %s", k)
+			}
+			seen[k] = true
+			if err := walk(hop.Jump, seen); err != nil {
+				return err
+			}
+			delete(seen, k)
+
+			hops = append(hops, hop)
+		}
+		return nil
+	}
+	err := walk(e.Jump, map[string]bool{entryKey(e.User, e.Host, e.Port): true})
+	return hops, err
+}
+
+// jumpChain is resolveJumps for callers that cannot go on without the chain.
+func jumpChain(m map[string]Entry, e Entry) []Entry {
+	hops, err := resolveJumps(m, e)
+	if err != nil {
+		die(strings.ToUpper(err.Error()[:1]) + err.Error()[1:])
+	}
+	return hops
+}
+
+// jumpSpec renders hops in the comma-separated form ssh -J expects.
+func jumpSpec(hops []Entry) string {
+	specs := make([]string, len(hops))
+	for i, h := range hops {
+		specs[i] = hopRef(h.User, h.Host, h.Port)
+	}
+	return strings.Join(specs, ",")
+}
+
+// proxyOpts returns the ssh options that route through hops. ProxyJump
+// cannot carry a key per hop, so when any hop has its own identity the
+// chain is built as nested ProxyCommands instead.
+func proxyOpts(hops []Entry) []string {
+	if len(hops) == 0 {
+		return nil
+	}
+	custom := false
+	for _, h := range hops {
+		custom = custom || h.Identity != ""
+	}
+	if !custom {
+		return []string{"-o", "ProxyJump=" + jumpSpec(hops)}
+	}
+
+	var cmd string
+	for _, h := range hops {
+		args := []string{"ssh"}
+		if cmd != "" {
+			// The outer ssh expands %-tokens first; escape the inner ones.
+			args = append(args, "-o", shellQuote("ProxyCommand="+strings.ReplaceAll(cmd, "%", "%%")))
+		}
+		if h.Identity != "" {
+			args = append(args, "-i", shellQuote(h.Identity), "-o", "IdentitiesOnly=yes")
+		}
+		args = append(args, "-p", strconv.Itoa(h.Port), "-W", "'[%h]:%p'", shellQuote(h.User+"@"+h.Host))
+		cmd = strings.Join(args, " ")
+	}
+	return []string{"-o", "ProxyCommand=" + cmd}
+}
+
+// sshOpts returns the connection options shared by the probe and the final exec.
+func sshOpts(e Entry, via []Entry) []string {
+	opts := []string{"-p", strconv.Itoa(e.Port)}
+	if e.Identity != "" {
+		opts = append(opts, "-i", e.Identity, "-o", "IdentitiesOnly=yes")
+	}
+	return append(opts, proxyOpts(via)...)
+}
+
+// probeStatus is the verdict of probeAuth.
+type probeStatus int
+
+const (
+	probeUnreachable probeStatus = iota
+	probeOK
+	probeHostKey
+	probeUnknownHostKey
+	probeAuthRefused
+)
+
+// probeResult describes one non-interactive login attempt. methods lists
+// what the server offers, as reported when it refuses our key.
+type probeResult struct {
+	status  probeStatus
+	methods []string
+	detail  string
+}
+
+func (p probeResult) offers(method string) bool {
+	for _, m := range p.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+var deniedRe = regexp.MustCompile(`Permission denied \(([^)]*)\)`)
+
+// probeAuth tries to log in to e (through via) with keys only. BatchMode
+// makes ssh fail instead of prompting, so a password-only host answers
+// right away with the methods it would accept.
+func probeAuth(e Entry, via []Entry) probeResult {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(5*(len(via)+2))*time.Second)
+	defer cancel()
+
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "ConnectTimeout=5",
+	}
+	args = append(args, sshOpts(e, via)...)
+	args = append(args, "-T", e.User+"@"+e.Host, "exit")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return probeResult{status: probeOK}
+	}
+
+	out := stderr.String()
+	switch {
+	case ctx.Err() != nil:
+		return probeResult{status: probeUnreachable, detail: "timed out"}
+	case strings.Contains(out, "you have requested strict checking"):
+		// Followed by "Host key verification failed" too, so it goes first.
+		return probeResult{status: probeUnknownHostKey}
+	case strings.Contains(out, "REMOTE HOST IDENTIFICATION HAS CHANGED"),
+		strings.Contains(out, "Host key verification failed"):
+		return probeResult{status: probeHostKey}
+	}
+	if m := deniedRe.FindStringSubmatch(out); m != nil {
+		return probeResult{status: probeAuthRefused, methods: splitList(m[1])}
+	}
+	if strings.Contains(out, "Too many authentication failures") ||
+		strings.Contains(out, "Received disconnect from") {
+		// The server hung up during authentication, e.g. after a loaded
+		// agent offered too many keys: it is up but did not take ours.
+		return probeResult{status: probeAuthRefused}
+	}
+	if exitErr, isExit := err.(*exec.ExitError); isExit && exitErr.ExitCode() != 255 {
+		// ssh got in; the remote shell just did not like "exit".
+		return probeResult{status: probeOK}
+	}
+
+	detail := strings.TrimSpace(out)
+	if i := strings.LastIndex(detail, "\n"); i >= 0 {
+		detail = detail[i+1:]
+	}
+	if detail == "" {
+		detail = err.Error()
+	}
+	return probeResult{status: probeUnreachable, detail: detail}
+}
+
+// ensureKey probes key auth on e (reached through via) and runs
+// ssh-copy-id when the server refuses the key but would take a password.
+// It reports whether the key works afterwards.
+func ensureKey(e Entry, via []Entry) bool {
+	target := entryKey(e.User, e.Host, e.Port)
+
+	p := probeAuth(e, via)
+	switch p.status {
+	case probeOK:
+		ok("Key authentication already working on " + target)
+		return true
+	case probeUnreachable:
+		warn(target + " is unreachable: " + p.detail)
+		return false
+	case probeHostKey:
+		warn("Host key verification failed for " + target + " — check ~/.ssh/known_hosts")
+		return false
+	case probeUnknownHostKey:
+		warn("No host key for " + target + " in ~/.ssh/known_hosts — connect to it once to trust it")
+		return false
+	}
+
+	if len(p.methods) > 0 {
+		info("Server offers: " + strings.Join(p.methods, ", "))
+		if !p.offers("publickey") {
+			warn(target + " does not accept public keys — nothing to install")
+			return false
+		}
+		if !p.offers("password") && !p.offers("keyboard-interactive") {
+			warn(target + " only accepts keys — add " + keyFor(e) + ".pub to its authorized_keys another way")
+			return false
+		}
+	}
+
+	info("Key not installed on " + target + " — installing SSH key...")
+
+	args := []string{
+		"-i", keyFor(e) + ".pub",
+		"-o", "StrictHostKeyChecking=yes",
+		"-p", strconv.Itoa(e.Port),
+	}
+	args = append(args, proxyOpts(via)...)
+	args = append(args, e.User+"@"+e.Host)
+
+	copyCmd := exec.Command("ssh-copy-id", args...)
+	copyCmd.Stdin = os.Stdin
+	copyCmd.Stdout = os.Stdout
+	copyCmd.Stderr = os.Stderr
+
+	if err := copyCmd.Run(); err != nil {
+		warn("Key copy failed on " + target)
+		return false
+	}
+
+	ok("Key copied successfully to " + target)
+	return true
+}
+
+// execSSH replaces the process with ssh; extra options go before the target
+// and remote, when set, is run in a terminal instead of the login shell.
+func execSSH(e Entry, remote string, extra ...string) {
+	binary, _ := exec.LookPath("ssh")
+	args := sshArgs(e, remote, extra...)
+	info("Connecting to " + entryKey(e.User, e.Host, e.Port) + " …")
+	syscall.Exec(binary, args, os.Environ())
+}
+
+// runRemote replaces the process with a non-interactive ssh running
+// command, so ssh-forge exits with the command's own exit code.
+func runRemote(e Entry, command []string) {
+	line := strings.Join(command, " ")
+	if e.Dir != "" {
+		line = "cd " + remoteDir(e.Dir) + " && " + line
+	}
+	binary, _ := exec.LookPath("ssh")
+	syscall.Exec(binary, append(sshArgs(e, ""), line), os.Environ())
+}
+
+// remoteDir quotes a remote directory, leaving a leading ~/ to the shell.
+func remoteDir(dir string) string {
+	if rest, found := strings.CutPrefix(dir, "~/"); found {
+		return "~/" + shellQuote(rest)
+	}
+	if dir == "~" {
+		return dir
+	}
+	return shellQuote(dir)
+}
+
+// remoteCommand is what an interactive session of e starts with, or ""
+// for the plain login shell.
+func remoteCommand(e Entry) string {
+	if e.Dir == "" {
+		return e.Command
+	}
+	command := e.Command
+	if command == "" {
+		command = `exec "$SHELL" -l`
+	}
+	return "cd " + remoteDir(e.Dir) + " && " + command
+}
+
+// sshArgs builds the full ssh command line (argv[0] included) for e. A
+// remote command gets -t so full-screen programs like tmux work.
+func sshArgs(e Entry, remote string, extra ...string) []string {
+	sshHost := e.Host
+	if strings.Contains(e.Host, ":") {
+		sshHost = "[" + e.Host + "]"
+	}
+
+	var via []Entry
+	if len(e.Jump) > 0 {
+		via = jumpChain(loadCache(), e)
+		info("Via " + jumpSpec(via))
+	}
+
+	args := append([]string{"ssh"}, sshOpts(e, via)...)
+	args = append(args, extra...)
+	if remote == "" {
+		return append(args, e.User+"@"+sshHost)
+	}
+	return append(args, "-t", e.User+"@"+sshHost, remote)
+}
+
+// --raw: cache ছাড়া সরাসরি ssh -p <port> <user@host>
+func rawConnect(e Entry) {
+	info("Raw connect (no cache) → " + entryKey(e.User, e.Host, e.Port))
+	execSSH(e, "")
+}
+
+// mergeEntry copies the options given on the command line into a cached entry.
+func mergeEntry(cached *Entry, e Entry) bool {
+	changed := false
+	if e.Alias != "" && e.Alias != cached.Alias {
+		cached.Alias = e.Alias
+		changed = true
+	}
+	if e.Identity != "" && e.Identity != cached.Identity {
+		cached.Identity = e.Identity
+		changed = true
+	}
+	if len(e.Jump) > 0 && strings.Join(e.Jump, ",") != strings.Join(cached.Jump, ",") {
+		cached.Jump = e.Jump
+		changed = true
+	}
+	if e.Ephemeral && !cached.Ephemeral {
+		cached.Ephemeral = true
+		changed = true
+	}
+	if e.TTL != 0 && e.TTL != cached.TTL {
+		cached.TTL = e.TTL
+		changed = true
+	}
+	if e.StartCmd != "" && e.StartCmd != cached.StartCmd {
+		cached.StartCmd = e.StartCmd
+		changed = true
+	}
+	if e.StopCmd != "" && e.StopCmd != cached.StopCmd {
+		cached.StopCmd = e.StopCmd
+		changed = true
+	}
+	if e.MAC != "" && e.MAC != cached.MAC {
+		cached.MAC = e.MAC
+		changed = true
+	}
+	if e.WakeAddr != "" && e.WakeAddr != cached.WakeAddr {
+		cached.WakeAddr = e.WakeAddr
+		changed = true
+	}
+	if e.Command != "" && e.Command != cached.Command {
+		cached.Command = e.Command
+		changed = true
+	}
+	if e.Dir != "" && e.Dir != cached.Dir {
+		cached.Dir = e.Dir
+		changed = true
+	}
+	return changed
+}
+
+func connect(e Entry) {
+	if e, ok := register(e); ok {
+		execSSH(e, remoteCommand(e))
+	}
+}
+
+// register does everything connect does short of starting ssh: host key
+// check, key install and cache update. It returns the stored entry.
+func register(e Entry) (Entry, bool) {
+	m := loadCache()
+	keyStr := entryKey(e.User, e.Host, e.Port)
+
+	if e.Alias != "" {
+		if other, found := findAlias(m, e.Alias); found && other != keyStr {
+			die("Alias '" + e.Alias + "' already used by " + other)
+		}
+	}
+
+	cached, exists := m[keyStr]
+	target := e
+	if exists {
+		mergeEntry(&cached, e)
+		target = cached
+	}
+	switch {
+	case target.StartCmd != "":
+		startHost(target, jumpChain(m, target))
+	case target.MAC != "":
+		if via := jumpChain(m, target); !sshUp(target, via) {
+			wakeHost(target, via, 5*time.Minute)
+		}
+	}
+
+	var hostKey string
+	if !exists {
+
+		info("First time connecting — checking key authentication...")
+
+		// Every hop needs our key too: the bastion before the inner host.
+		// Hops already in the cache had theirs installed at registration.
+		via := jumpChain(m, e)
+		for i, hop := range via {
+			if _, known := m[entryKey(hop.User, hop.Host, hop.Port)]; known {
+				continue
+			}
+			if _, trusted := trustHostKey(hop, via[:i]); !trusted || !ensureKey(hop, via[:i]) {
+				warn("Jump host unusable — host not added to cache")
+				return e, false
+			}
+		}
+
+		var trusted bool
+		if hostKey, trusted = trustHostKey(e, via); !trusted || !ensureKey(e, via) {
+			warn("Host not added to cache")
+			return e, false
+		}
+	} else {
+		via := jumpChain(m, cached)
+		var refreshed bool
+		hostKey, refreshed = verifyHostKey(cached, via)
+		// A re-created VM has a new host key and none of our keys yet.
+		if refreshed && !ensureKey(cached, via) {
+			warn("Host not updated")
+			return e, false
+		}
+	}
+
+	// Register or update the entry and count this connection in one locked
+	// write. Key install can take minutes, so the cache is re-read here.
+	now := time.Now().Unix()
+	updated := false
+	updateCache(func(m map[string]Entry) bool {
+		if e.Alias != "" {
+			if other, found := findAlias(m, e.Alias); found && other != keyStr {
+				die("Alias '" + e.Alias + "' already used by " + other)
+			}
+		}
+		cur, found := m[keyStr]
+		if !found {
+			cur = e
+			cur.FirstSeen = now
+		} else {
+			updated = mergeEntry(&cur, e)
+		}
+		if hostKey != "" {
+			cur.HostKey = hostKey
+		}
+		cur.LastUsed = now
+		cur.Uses++
+		m[keyStr] = cur
+		e = cur
+		return true
+	})
+
+	if !exists {
+		ok("Host registered")
+	} else if updated {
+		ok("Host updated")
+	}
+	return e, true
+}
+
+// hostKeyAlgorithms lists the signature algorithms that use a key of the
+// same type as hostKey; RSA keys sign with several.
+func hostKeyAlgorithms(hostKey string) string {
+	kind, _, _ := strings.Cut(hostKey, " ")
+	if kind == "ssh-rsa" {
+		return "rsa-sha2-512,rsa-sha2-256,ssh-rsa"
+	}
+	return kind
+}
+
+// scanHostKey asks e (reached through via) for its host key without
+// logging in: ssh records the key in a throwaway known_hosts file and then
+// gives up because no authentication method is allowed. When e has a
+// pinned key, the server is asked for a key of that type, so a newly added
+// key type does not look like a changed key; a server that no longer has
+// that type is asked again for any key.
+func scanHostKey(e Entry, via []Entry) (string, error) {
+	dir, err := os.MkdirTemp("", "ssh-forge-hostkey-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	kh := filepath.Join(dir, "known_hosts")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(10*(len(via)+1))*time.Second)
+	defer cancel()
+
+	args := []string{
+		"-o", "UserKnownHostsFile=" + kh,
+		"-o", "GlobalKnownHostsFile=/dev/null",
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "HashKnownHosts=no",
+		"-o", "BatchMode=yes",
+		"-o", "PreferredAuthentications=none",
+		"-o", "ConnectTimeout=5",
+	}
+	if e.HostKey != "" {
+		args = append(args, "-o", "HostKeyAlgorithms="+hostKeyAlgorithms(e.HostKey))
+	}
+	args = append(args, sshOpts(e, via)...)
+	args = append(args, "-T", e.User+"@"+e.Host, "exit")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stderr = &stderr
+	cmd.Run()
+
+	data, _ := os.ReadFile(kh)
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 3 {
+			return fields[1] + " " + fields[2], nil
+		}
+	}
+
+	msg := strings.TrimSpace(stderr.String())
+	if e.HostKey != "" && strings.Contains(msg, "no matching host key type") {
+		e.HostKey = ""
+		return scanHostKey(e, via)
+	}
+	if i := strings.LastIndex(msg, "\n"); i >= 0 {
+		msg = msg[i+1:]
+	}
+	if msg == "" {
+		msg = "no host key received"
+	}
+	return "", fmt.Errorf("%s", msg)
+}
+
+// fingerprint renders "type base64" the way ssh-keygen -l does.
+func fingerprint(hostKey string) string {
+	fields := strings.Fields(hostKey)
+	if len(fields) < 2 {
+		return hostKey
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return hostKey
+	}
+	sum := sha256.Sum256(blob)
+	return fields[0] + " SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// knownHostKeys returns the "type base64" keys known_hosts holds for e.
+func knownHostKeys(e Entry) []string {
+	out, _ := exec.Command("ssh-keygen", "-f", knownHosts, "-F", knownHostName(e.Host, e.Port)).Output()
+	var keys []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		keys = append(keys, fields[1]+" "+fields[2])
+	}
+	return keys
+}
+
+// sameType returns the keys in known of the same algorithm as hostKey.
+// Hosts usually have several (UpdateHostKeys records them all); only keys
+// of one type can be compared.
+func sameType(known []string, hostKey string) []string {
+	kind, _, _ := strings.Cut(hostKey, " ")
+	var out []string
+	for _, k := range known {
+		if t, _, _ := strings.Cut(k, " "); t == kind {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// pinKnownHost makes hostKey the only known_hosts key of its type for e,
+// so plain ssh (and everything ssh-forge runs through it) enforces the
+// pinned key too. Keys of other types are left alone.
+func pinKnownHost(e Entry, hostKey string) {
+	known := knownHostKeys(e)
+	same := sameType(known, hostKey)
+	if len(same) == 1 && same[0] == hostKey {
+		return
+	}
+
+	// ssh-keygen -R drops every type, so the others are written back.
+	var keep []string
+	for _, k := range known {
+		if len(sameType([]string{k}, hostKey)) == 0 {
+			keep = append(keep, k)
+		}
+	}
+	forgetKnownHost(e.Host, e.Port)
+	f, err := os.OpenFile(knownHosts, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		warn("Cannot update known_hosts: " + err.Error())
+		return
+	}
+	defer f.Close()
+	for _, k := range append(keep, hostKey) {
+		fmt.Fprintln(f, knownHostName(e.Host, e.Port)+" "+k)
+	}
+}
+
+// knownMatches reports whether known_hosts agrees with hostKey: it holds
+// that key, or no key of the same type at all.
+func knownMatches(e Entry, hostKey string) bool {
+	same := sameType(knownHostKeys(e), hostKey)
+	for _, k := range same {
+		if k == hostKey {
+			return true
+		}
+	}
+	return len(same) == 0
+}
+
+func hostKeyDiff(pinned, current string) {
+	fmt.Println(RED + "  - " + fingerprint(pinned) + "   (pinned)" + NC)
+	fmt.Println(GREEN + "  + " + fingerprint(current) + "   (offered now)" + NC)
+}
+
+// trustHostKey reads the host key of a host that is not cached yet and asks
+// before trusting it, unless known_hosts already vouches for it.
+func trustHostKey(e Entry, via []Entry) (string, bool) {
+	target := entryKey(e.User, e.Host, e.Port)
+	hostKey, err := scanHostKey(e, via)
+	if err != nil {
+		warn("Cannot read host key of " + target + ": " + err.Error())
+		return "", false
+	}
+
+	known := knownHostKeys(e)
+	for _, k := range known {
+		if k == hostKey {
+			ok("Host key matches known_hosts: " + fingerprint(hostKey))
+			pinKnownHost(e, hostKey)
+			return hostKey, true
+		}
+	}
+
+	if same := sameType(known, hostKey); len(same) > 0 {
+		warn("known_hosts has a different key for " + target + "!")
+		hostKeyDiff(same[0], hostKey)
+	} else {
+		info("Host key of " + target + ": " + fingerprint(hostKey))
+	}
+	if !confirm("Trust this host key?") {
+		return "", false
+	}
+	pinKnownHost(e, hostKey)
+	return hostKey, true
+}
+
+// verifyHostKey checks a cached host against its pinned key and stops on a
+// mismatch. Entries from before pinning get their current key pinned, and
+// ephemeral entries are re-pinned (refreshed is then true). It returns the
+// key to store, or "" when the host could not be asked.
+func verifyHostKey(e Entry, via []Entry) (hostKey string, refreshed bool) {
+	current, err := scanHostKey(e, via)
+	if err != nil {
+		// Unreachable: let ssh itself report why.
+		return "", false
+	}
+
+	if e.Ephemeral && e.HostKey != current {
+		if e.HostKey != "" || !knownMatches(e, current) {
+			info("Ephemeral host " + targetName(e) + " was re-created — refreshing its host key")
+			forgetKnownHost(e.Host, e.Port)
+			pinKnownHost(e, current)
+			info("Pinned host key " + fingerprint(current))
+			return current, true
+		}
+	}
+
+	if e.HostKey == "" {
+		if !knownMatches(e, current) {
+			warn("Host key of " + entryKey(e.User, e.Host, e.Port) + " differs from known_hosts!")
+			hostKeyDiff(sameType(knownHostKeys(e), current)[0], current)
+			die("Not connecting. If the host was reinstalled: ssh-forge " + targetName(e) + " --accept-new-hostkey")
+		}
+		pinKnownHost(e, current)
+		info("Pinned host key " + fingerprint(current))
+		return current, false
+	}
+
+	if current != e.HostKey {
+		fmt.Println(RED + "❌ HOST KEY CHANGED for " + entryKey(e.User, e.Host, e.Port) + NC)
+		hostKeyDiff(e.HostKey, current)
+		fmt.Println("Someone may be intercepting the connection, or the host was reinstalled.")
+		die("Not connecting. If the change is expected: ssh-forge " + targetName(e) + " --accept-new-hostkey")
+	}
+	pinKnownHost(e, current)
+	return current, false
+}
+
+// acceptHostKey re-pins a cached host after an intended reinstall.
+func acceptHostKey(e Entry) {
+	k, cached := mustCached(e)
+	current, err := scanHostKey(cached, jumpChain(loadCache(), cached))
+	if err != nil {
+		die("Cannot read host key of " + k + ": " + err.Error())
+	}
+	if current == cached.HostKey {
+		info("Host key unchanged: " + fingerprint(current))
+		return
+	}
+
+	if cached.HostKey != "" {
+		hostKeyDiff(cached.HostKey, current)
+	} else {
+		info("Host key of " + k + ": " + fingerprint(current))
+	}
+	if !confirm("Pin the new host key?") {
+		die("Host key not changed")
+	}
+
+	updateCache(func(m map[string]Entry) bool {
+		cur, found := m[k]
+		if !found {
+			die("Entry not found: " + k)
+		}
+		cur.HostKey = current
+		m[k] = cur
+		return true
+	})
+	pinKnownHost(cached, current)
+	ok("New host key pinned for " + k)
+}
+
+// targetName is how the user would name e on the command line.
+func targetName(e Entry) string {
+	if e.Alias != "" {
+		return e.Alias
+	}
+	return entryKey(e.User, e.Host, e.Port)
+}
+
+func knownHostName(host string, port int) string {
+	if port == 22 {
+		return host
+	}
+	return fmt.Sprintf("[%s]:%d", host, port)
+}
+
+func forgetKnownHost(host string, port int) {
+	exec.Command("ssh-keygen", "-f", knownHosts, "-R", knownHostName(host, port)).Run()
+}
+
+func remove(e Entry) {
+	keyStr := entryKey(e.User, e.Host, e.Port)
+
+	updateCache(func(m map[string]Entry) bool {
+		if _, ok := m[keyStr]; !ok {
+			die("Entry not found")
+		}
+		delete(m, keyStr)
+		return true
+	})
+
+	forgetKnownHost(e.Host, e.Port)
+	ok("Removed known_host entry")
+
+	ok("Removed entry from ssh-forge cache")
+}
+
+// removeTagged drops every entry carrying tag after one confirmation.
+func removeTagged(tag string) {
+	m := loadCache()
+	keys := sortedKeys(m, tag)
+	if len(keys) == 0 {
+		die("No hosts tagged '" + tag + "'")
+	}
+
+	for _, k := range keys {
+		fmt.Println("  " + entryLine(k, m[k]))
+	}
+	if !confirm(fmt.Sprintf("Remove %d host(s) tagged '%s'?", len(keys), tag)) {
+		warn("Cancelled")
+		return
+	}
+
+	updateCache(func(m map[string]Entry) bool {
+		for _, k := range keys {
+			delete(m, k)
+		}
+		return true
+	})
+	for _, k := range keys {
+		forgetKnownHost(m[k].Host, m[k].Port)
+	}
+
+	ok(fmt.Sprintf("Removed %d host(s) from ssh-forge cache", len(keys)))
+}
+
+func confirm(question string) bool {
+	fmt.Print(question + " [y/N]: ")
+	var answer string
+	fmt.Scanln(&answer)
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// editTags handles "--tag add|remove a,b" on a cached entry.
+func editTags(e Entry, action, tags string) {
+	keyStr := entryKey(e.User, e.Host, e.Port)
+	if action != "add" && action != "remove" && action != "rm" {
+		die("Usage: ssh-forge target --tag add|remove tag[,tag]")
+	}
+
+	var cached Entry
+	updateCache(func(m map[string]Entry) bool {
+		var exists bool
+		cached, exists = m[keyStr]
+		if !exists {
+			die("Entry not found — connect once before tagging")
+		}
+
+		for _, t := range splitList(tags) {
+			checkTag(t)
+			if action == "add" {
+				if !hasTag(cached, t) {
+					cached.Tags = append(cached.Tags, t)
+				}
+				continue
+			}
+			kept := cached.Tags[:0]
+			for _, old := range cached.Tags {
+				if old != t {
+					kept = append(kept, old)
+				}
+			}
+			cached.Tags = kept
+		}
+		sort.Strings(cached.Tags)
+
+		m[keyStr] = cached
+		return true
+	})
+
+	if len(cached.Tags) == 0 {
+		ok(keyStr + " has no tags")
+	} else {
+		ok(keyStr + " tags: " + strings.Join(cached.Tags, ", "))
+	}
+}
+
+// frecency ranks an entry by use count weighted by how recently it was used.
+func frecency(e Entry, now int64) int {
+	if e.Uses == 0 {
+		return 0
+	}
+	age := time.Duration(now-e.LastUsed) * time.Second
+	weight := 10
+	switch {
+	case age < 4*24*time.Hour:
+		weight = 100
+	case age < 14*24*time.Hour:
+		weight = 70
+	case age < 31*24*time.Hour:
+		weight = 50
+	case age < 90*24*time.Hour:
+		weight = 30
+	}
+	return e.Uses * weight
+}
+
+// sortBy orders keys in place: name (default), recent, frequent or frecency.
+func sortBy(m map[string]Entry, keys []string, mode string) {
+	now := time.Now().Unix()
+	var less func(a, b Entry) bool
+	switch mode {
+	case "", "name":
+		sort.Strings(keys)
+		return
+	case "recent":
+		less = func(a, b Entry) bool { return a.LastUsed > b.LastUsed }
+	case "frequent":
+		less = func(a, b Entry) bool { return a.Uses > b.Uses }
+	case "frecency":
+		less = func(a, b Entry) bool { return frecency(a, now) > frecency(b, now) }
+	default:
+		die("Unknown sort '" + mode + "'. Use: recent, frequent, frecency or name")
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := m[keys[i]], m[keys[j]]
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		if a.LastUsed != b.LastUsed {
+			return a.LastUsed > b.LastUsed
+		}
+		return keys[i] < keys[j]
+	})
+}
+
+func ago(ts int64) string {
+	d := time.Since(time.Unix(ts, 0))
+	if d < time.Minute {
+		return "just now"
+	}
+	return span(d) + " ago"
+}
+
+// span renders d coarsely: <1m, 5m, 3h, 2d.
+func span(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "<1m"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+// historyNote is the "12× · 2h ago" suffix shown by list --sort.
+func historyNote(e Entry) string {
+	if e.Uses == 0 {
+		return "  · never used"
+	}
+	return fmt.Sprintf("  · %d× · %s", e.Uses, ago(e.LastUsed))
+}
+
+// list prints the cache in the given --sort order (name, recent, frequent
+// or frecency), with use counts for all but name. Without a tag filter,
+// tagged hosts are grouped under their tags; a host with several tags shows
+// up in each group.
+func list(tag, order string) {
+	m := loadCache()
+	keys := sortedKeys(m, tag)
+	sortBy(m, keys, order)
+	line := func(k string) string {
+		l := entryLine(k, m[k])
+		if order != "" && order != "name" {
+			l += historyNote(m[k])
+		}
+		if m[k].Ephemeral {
+			l += "  · ephemeral"
+			if t := expiresAt(m[k]); t != 0 {
+				l += ", expires in " + span(time.Until(time.Unix(t, 0)))
+			}
+		}
+		if m[k].Note != "" {
+			l += "  # " + m[k].Note
+		}
+		return l
+	}
+	if len(keys) == 0 {
+		fmt.Println("(empty)")
+		return
+	}
+
+	groups := make(map[string][]string)
+	var untagged []string
+	for _, k := range keys {
+		if len(m[k].Tags) == 0 {
+			untagged = append(untagged, k)
+		}
+		for _, t := range m[k].Tags {
+			groups[t] = append(groups[t], k)
+		}
+	}
+
+	if tag != "" || len(groups) == 0 {
+		for _, k := range keys {
+			fmt.Println(line(k))
+		}
+		return
+	}
+
+	names := make([]string, 0, len(groups))
+	for t := range groups {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+
+	for _, t := range names {
+		fmt.Println(BLUE + "[" + t + "]" + NC)
+		for _, k := range groups[t] {
+			fmt.Println("  " + line(k))
+		}
+	}
+	if len(untagged) > 0 {
+		fmt.Println(BLUE + "[untagged]" + NC)
+		for _, k := range untagged {
+			fmt.Println("  " + line(k))
+		}
+	}
+}
+
+// fzfMenu lists hosts most-frecent first; --tiebreak=index keeps that
+// order among equally good matches while typing.
+func fzfMenu(tag string) {
+	need("fzf")
+
+	m := loadCache()
+	keys := sortedKeys(m, tag)
+	sortBy(m, keys, "frecency")
+
+	// Running QEMU guests show up live: cached ones are marked, new ones
+	// are listed first and registered when picked.
+	running := make(map[string]bool)
+	guests := make(map[string]qemuGuest)
+	var sb strings.Builder
+	if tag == "" || tag == "qemu" {
+		for _, g := range discoverQEMU() {
+			if k, found := cachedGuest(m, g); found {
+				running[k] = true
+				continue
+			}
+			e := guestEntry(g)
+			k := entryKey(e.User, e.Host, e.Port)
+			guests[k] = g
+			sb.WriteString(entryLine(k, e) + "  [qemu: running, not cached]\n")
+		}
+	}
+	if len(keys) == 0 && len(guests) == 0 {
+		fmt.Println("(empty)")
+		return
+	}
+
+	for _, k := range keys {
+		sb.WriteString(entryLine(k, m[k]))
+		if running[k] {
+			sb.WriteString("  ▶ running")
+		}
+		if len(m[k].Tags) > 0 {
+			sb.WriteString("  [" + strings.Join(m[k].Tags, ",") + "]")
+		}
+		if m[k].Note != "" {
+			sb.WriteString("  # " + m[k].Note)
+		}
+		sb.WriteString("\n")
+	}
+
+	cmd := exec.Command("fzf", "--prompt=SSH > ", "--tiebreak=index")
+	cmd.Stdin = strings.NewReader(sb.String())
+
+	out, err := cmd.Output()
+	if err != nil {
+		os.Exit(0)
+	}
+
+	selected := strings.Fields(string(out))
+	if len(selected) == 0 {
+		return
+	}
+
+	if e, found := m[selected[0]]; found {
+		connect(e)
+	} else if g, found := guests[selected[0]]; found {
+		connectGuest(g)
+	}
+}
+
+// sshBlock is one Host (or Match) section of an OpenSSH config file.
+// Options are kept in file order because ssh uses the first value it sees.
+type sshBlock struct {
+	patterns []string
+	opts     [][2]string
+}
+
+type sshConfig struct {
+	blocks []sshBlock
+}
+
+// splitConfigArgs splits an ssh_config value on whitespace, honouring quotes.
+func splitConfigArgs(s string) []string {
+	var args []string
+	var cur strings.Builder
+	quoted, inArg := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+func expandHome(path string) string {
+	if path == "~" {
+		return home
+	}
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(home, path[2:])
+	}
+	return strings.ReplaceAll(path, "%d", home)
+}
+
+// read parses path into c, following Include directives. Included files
+// continue the block that was open at the Include line, as ssh does.
+func (c *sshConfig) read(path string, depth int) error {
+	if depth > 16 {
+		return fmt.Errorf("Include nested too deeply at %s", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kw, rest := line, ""
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			kw = line[:i]
+			rest = strings.TrimLeft(line[i:], " \t")
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+		}
+		kw = strings.ToLower(kw)
+		args := splitConfigArgs(rest)
+
+		switch kw {
+		case "host":
+			c.blocks = append(c.blocks, sshBlock{patterns: args})
+		case "match":
+			// Match criteria cannot be evaluated offline; the block never applies.
+			c.blocks = append(c.blocks, sshBlock{})
+		case "include":
+			for _, inc := range args {
+				inc = expandHome(inc)
+				if !filepath.IsAbs(inc) {
+					inc = filepath.Join(home, ".ssh", inc)
+				}
+				matches, _ := filepath.Glob(inc)
+				sort.Strings(matches)
+				for _, f := range matches {
+					if err := c.read(f, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if len(args) == 0 {
+				return fmt.Errorf("%s:%d: %s has no value", path, n+1, kw)
+			}
+			if len(c.blocks) == 0 {
+				c.blocks = append(c.blocks, sshBlock{patterns: []string{"*"}})
+			}
+			b := &c.blocks[len(c.blocks)-1]
+			b.opts = append(b.opts, [2]string{kw, strings.Join(args, " ")})
+		}
+	}
+	return nil
+}
+
+// matchHost applies ssh_config pattern rules: any positive match wins
+// unless a negated pattern also matches.
+func matchHost(patterns []string, name string) bool {
+	matched := false
+	for _, p := range patterns {
+		for _, alt := range strings.Split(p, ",") {
+			negate := strings.HasPrefix(alt, "!")
+			alt = strings.TrimPrefix(alt, "!")
+			if hit, _ := filepath.Match(alt, name); hit {
+				if negate {
+					return false
+				}
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// names returns the concrete Host names, i.e. those without wildcards.
+func (c *sshConfig) names() []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, b := range c.blocks {
+		for _, p := range b.patterns {
+			if strings.ContainsAny(p, "*?!,% \t") || seen[p] {
+				continue
+			}
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// resolve collects the effective options for name, first value wins.
+func (c *sshConfig) resolve(name string) map[string]string {
+	opts := make(map[string]string)
+	for _, b := range c.blocks {
+		if !matchHost(b.patterns, name) {
+			continue
+		}
+		for _, o := range b.opts {
+			if _, set := opts[o[0]]; !set {
+				opts[o[0]] = o[1]
+			}
+		}
+	}
+	return opts
+}
+
+func localUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// configRef turns a ProxyJump element ([user@]host[:port], ssh:// allowed)
+// into an entry. Names defined in the same config resolve through it.
+func configRef(c *sshConfig, ref string) (Entry, error) {
+	ref = strings.TrimSuffix(strings.TrimPrefix(ref, "ssh://"), "/")
+
+	u, hostPort := "", ref
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		u, hostPort = ref[:i], ref[i+1:]
+	}
+
+	h, p := hostPort, ""
+	if strings.HasPrefix(hostPort, "[") || strings.Count(hostPort, ":") == 1 {
+		var err error
+		if h, p, err = net.SplitHostPort(hostPort); err != nil {
+			h = strings.Trim(hostPort, "[]")
+		}
+	}
+
+	opts := c.resolve(h)
+	if hn := opts["hostname"]; hn != "" {
+		h = strings.ReplaceAll(hn, "%h", h)
+	}
+	if u == "" {
+		u = opts["user"]
+	}
+	if u == "" {
+		u = localUser()
+	}
+	if p == "" {
+		p = opts["port"]
+	}
+	if p == "" {
+		p = "22"
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return Entry{}, fmt.Errorf("invalid port in %q", ref)
+	}
+	return Entry{User: u, Host: h, Port: port}, nil
+}
+
+// importSSHConfig turns wildcard-free Host blocks into cache entries.
+func importSSHConfig(path string, assumeYes bool) {
+	if path == "" {
+		path = filepath.Join(home, ".ssh", "config")
+	}
+	path = expandHome(path)
+
+	var c sshConfig
+	if err := c.read(path, 0); err != nil {
+		die("Cannot read ssh config: " + err.Error())
+	}
+
+	m := loadCache()
+	var keys []string
+	found := make(map[string]Entry)
+
+	for _, name := range c.names() {
+		e, err := configRef(&c, name)
+		if err != nil {
+			warn("Skipping " + name + ": " + err.Error())
+			continue
+		}
+		ref := entryKey(e.User, e.Host, e.Port)
+
+		if _, exists := m[ref]; exists {
+			info("Skipping " + name + ": " + ref + " already cached")
+			continue
+		}
+		if _, dup := found[ref]; dup {
+			info("Skipping " + name + ": same target as an earlier Host")
+			continue
+		}
+
+		if nameRe.MatchString(name) {
+			if other, taken := findAlias(m, name); taken {
+				warn("Alias " + name + " already used by " + other + " — importing without alias")
+			} else {
+				e.Alias = name
+			}
+		}
+
+		opts := c.resolve(name)
+		if id := opts["identityfile"]; id != "" && id != "none" {
+			id = expandHome(id)
+			if _, err := os.Stat(id); err == nil {
+				e.Identity = id
+			} else {
+				warn(name + ": IdentityFile " + id + " not found — using default key")
+			}
+		}
+		if pj := opts["proxyjump"]; pj != "" && pj != "none" {
+			for _, hop := range splitList(pj) {
+				h, err := configRef(&c, hop)
+				if err != nil {
+					warn(name + ": bad ProxyJump " + hop)
+					continue
+				}
+				e.Jump = append(e.Jump, hopRef(h.User, h.Host, h.Port))
+			}
+		}
+
+		keys = append(keys, ref)
+		found[ref] = e
+	}
+
+	if len(keys) == 0 {
+		info("Nothing new to import from " + path)
+		return
+	}
+
+	fmt.Println(BLUE + "Hosts to import from " + path + ":" + NC)
+	for _, k := range keys {
+		e := found[k]
+		line := "  " + entryLine(k, e)
+		if e.Identity != "" {
+			line += "  key=" + e.Identity
+		}
+		if len(e.Jump) > 0 {
+			line += "  via=" + strings.Join(e.Jump, ",")
+		}
+		fmt.Println(line)
+	}
+
+	if !assumeYes && !confirm(fmt.Sprintf("Import %d host(s)?", len(keys))) {
+		warn("Cancelled")
+		return
+	}
+
+	added, now := 0, time.Now().Unix()
+	updateCache(func(m map[string]Entry) bool {
+		for _, k := range keys {
+			if _, exists := m[k]; exists {
+				continue
+			}
+			e := found[k]
+			if e.Alias != "" {
+				if _, taken := findAlias(m, e.Alias); taken {
+					e.Alias = ""
+				}
+			}
+			e.FirstSeen = now
+			m[k] = e
+			added++
+		}
+		return added > 0
+	})
+	ok(fmt.Sprintf("Imported %d host(s)", added))
+}
+
+var unsafeHostChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// exportName is the Host name an entry gets in the exported ssh config.
+func exportName(e Entry) string {
+	if e.Alias != "" {
+		return e.Alias
+	}
+	return "sf-" + unsafeHostChars.ReplaceAllString(fmt.Sprintf("%s-%s-%d", e.User, e.Host, e.Port), "-")
+}
+
+// renderSSHConfig writes one Host block per entry. Cached jump hops are
+// referenced by their exported name so each hop keeps its own identity.
+func renderSSHConfig(m map[string]Entry) string {
+	var sb strings.Builder
+	sb.WriteString("# Generated by ssh-forge — do not edit.\n")
+	sb.WriteString("# Regenerate with: ssh-forge --export-ssh-config\n")
+
+	for _, k := range sortedKeys(m, "") {
+		e := m[k]
+		fmt.Fprintf(&sb, "\n# %s\nHost %s\n", k, exportName(e))
+		fmt.Fprintf(&sb, "    HostName %s\n", e.Host)
+		fmt.Fprintf(&sb, "    User %s\n", e.User)
+		fmt.Fprintf(&sb, "    Port %d\n", e.Port)
+		if e.Identity != "" {
+			fmt.Fprintf(&sb, "    IdentityFile \"%s\"\n", e.Identity)
+			sb.WriteString("    IdentitiesOnly yes\n")
+		}
+		if len(e.Jump) > 0 {
+			hops := make([]string, 0, len(e.Jump))
+			for _, ref := range e.Jump {
+				hop, isTarget := parseTarget(ref)
+				if isTarget {
+					if cached, found := m[entryKey(hop.User, hop.Host, hop.Port)]; found {
+						hops = append(hops, exportName(cached))
+					} else {
+						hops = append(hops, jumpSpec([]Entry{hop}))
+					}
+				} else if k, found := findAlias(m, ref); found {
+					hops = append(hops, exportName(m[k]))
+				} else {
+					hops = append(hops, ref)
+				}
+			}
+			fmt.Fprintf(&sb, "    ProxyJump %s\n", strings.Join(hops, ","))
+		}
+	}
+	return sb.String()
+}
+
+// exportSSHConfig writes the cache as an ssh config fragment to path,
+// or to stdout when path is "-".
+func exportSSHConfig(m map[string]Entry, path string) error {
+	out := renderSSHConfig(m)
+	if path == "-" {
+		fmt.Print(out)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileSync(path, []byte(out), 0600)
+}
+
+// exportIncluded reports whether ~/.ssh/config includes the export file.
+func exportIncluded(path string) bool {
+	data, err := os.ReadFile(filepath.Join(home, ".ssh", "config"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := splitConfigArgs(strings.TrimSpace(line))
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "include") {
+			continue
+		}
+		for _, inc := range fields[1:] {
+			inc = expandHome(inc)
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(home, ".ssh", inc)
+			}
+			if hit, _ := filepath.Match(inc, path); hit {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func exportCommand(args []string) {
+	if mode := flagValue(args, "--auto"); mode != "" {
+		switch mode {
+		case "on", "true", "yes":
+			saveSetting("auto_export", "true")
+			ok("Auto-export enabled — " + exportFile + " is rewritten on every cache change")
+		case "off", "false", "no":
+			saveSetting("auto_export", "false")
+			ok("Auto-export disabled")
+			return
+		default:
+			die("Usage: ssh-forge --export-ssh-config --auto on|off")
+		}
+	}
+
+	path := exportFile
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		path = expandHome(args[0])
+	}
+
+	if err := exportSSHConfig(loadCache(), path); err != nil {
+		die("Export failed: " + err.Error())
+	}
+	if path == "-" {
+		return
+	}
+	ok("Exported ssh config → " + path)
+
+	if !exportIncluded(path) {
+		info("Add this line near the top of ~/.ssh/config (before any Host block):")
+		fmt.Println("    Include " + strings.TrimPrefix(path, filepath.Join(home, ".ssh")+"/"))
+	}
+}
+
+// connectLast reconnects to the most recently used host.
+func connectLast() {
+	m := loadCache()
+	keys := sortedKeys(m, "")
+	sortBy(m, keys, "recent")
+	if len(keys) == 0 || m[keys[0]].LastUsed == 0 {
+		die("No connection history yet")
+	}
+	connect(m[keys[0]])
+}
+
+type pingResult struct {
+	key     string
+	alive   bool
+	latency time.Duration
+	banner  string
+	auth    probeResult
+	err     string
+}
+
+// qemuGuest is a running QEMU process with a user-mode forward to port 22.
+type qemuGuest struct {
+	PID  int
+	Name string
+	Host string
+	Port int
+}
+
+// discoverQEMU scans /proc for qemu-system-* (and qemu-kvm) processes and
+// returns one guest per hostfwd rule that reaches guest port 22.
+func discoverQEMU() []qemuGuest {
+	files, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	var guests []qemuGuest
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		bin := filepath.Base(args[0])
+		if !strings.HasPrefix(bin, "qemu-system-") && bin != "qemu-kvm" {
+			continue
+		}
+		pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(f)))
+
+		name := ""
+		for i, a := range args {
+			if (a == "-name" || a == "--name") && i+1 < len(args) {
+				// -name guest=vm1,debug-threads=on or just -name vm1
+				name, _, _ = strings.Cut(args[i+1], ",")
+				name = strings.TrimPrefix(name, "guest=")
+			}
+		}
+
+		for _, a := range args {
+			for _, opt := range strings.Split(a, ",") {
+				spec, isFwd := strings.CutPrefix(opt, "hostfwd=")
+				if !isFwd {
+					continue
+				}
+				if g, found := parseHostfwd(spec); found {
+					g.PID, g.Name = pid, name
+					guests = append(guests, g)
+				}
+			}
+		}
+	}
+	sort.Slice(guests, func(i, j int) bool { return guests[i].Port < guests[j].Port })
+	return guests
+}
+
+// parseHostfwd reads "[tcp|udp]:[hostaddr]:hostport-[guestaddr]:guestport"
+// and keeps TCP forwards to the guest's ssh port.
+func parseHostfwd(spec string) (qemuGuest, bool) {
+	hostSide, guestSide, found := strings.Cut(spec, "-")
+	if !found {
+		return qemuGuest{}, false
+	}
+	parts := strings.Split(hostSide, ":")
+	if len(parts) != 3 || (parts[0] != "" && parts[0] != "tcp") {
+		return qemuGuest{}, false
+	}
+	if i := strings.LastIndex(guestSide, ":"); i < 0 || guestSide[i+1:] != "22" {
+		return qemuGuest{}, false
+	}
+	port, err := checkPort(parts[2])
+	if err != nil {
+		return qemuGuest{}, false
+	}
+	host := parts[1]
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	return qemuGuest{Host: host, Port: port}, true
+}
+
+// guestEntry turns a guest into a ready-made entry. The alias is the VM
+// name made safe for aliases; the user comes from qemu_user/default_user.
+func guestEntry(g qemuGuest) Entry {
+	e := Entry{
+		User: setting("qemu_user", setting("default_user", localUser())),
+		Host: g.Host,
+		Port: g.Port,
+		Tags: []string{"qemu"},
+	}
+	if g.Name != "" {
+		alias := strings.Map(func(r rune) rune {
+			if r == '.' || r == '_' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+				return r
+			}
+			return '-'
+		}, g.Name)
+		if reservedNames[alias] {
+			alias = "vm-" + alias
+		}
+		if nameRe.MatchString(alias) {
+			e.Alias = alias
+		}
+	}
+	return e
+}
+
+// cachedGuest returns the cache key of an entry that points at g, if any.
+func cachedGuest(m map[string]Entry, g qemuGuest) (string, bool) {
+	for _, k := range sortedKeys(m, "") {
+		e := m[k]
+		if e.Port == g.Port && len(e.Jump) == 0 &&
+			(e.Host == g.Host || e.Host == "localhost" && g.Host == "127.0.0.1") {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// connectGuest connects to a discovered guest. When the VM's name is
+// already the alias of another local entry the guest was restarted on a
+// new port, so that entry is moved instead of registering a second one.
+func connectGuest(g qemuGuest) {
+	m := loadCache()
+	if k, found := cachedGuest(m, g); found {
+		connect(m[k])
+		return
+	}
+
+	e := guestEntry(g)
+	if k, taken := findAlias(m, e.Alias); taken && e.Alias != "" {
+		old := m[k]
+		if old.Host == g.Host && len(old.Jump) == 0 {
+			info(fmt.Sprintf("%s moved from port %d to %d", e.Alias, old.Port, g.Port))
+			editEntry(old, []string{"--port", strconv.Itoa(g.Port)})
+			connect(loadCache()[entryKey(old.User, old.Host, g.Port)])
+			return
+		}
+		warn("Alias " + e.Alias + " already used by " + k + " — connecting without alias")
+		e.Alias = ""
+	}
+	connect(e)
+}
+
+// discoverCommand lists running guests, or connects to the one named.
+func discoverCommand(args []string) {
+	guests := discoverQEMU()
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		for _, g := range guests {
+			if g.Name == args[0] || guestEntry(g).Alias == args[0] || strconv.Itoa(g.Port) == args[0] {
+				connectGuest(g)
+				return
+			}
+		}
+		die("No running QEMU guest named " + args[0])
+	}
+
+	if len(guests) == 0 {
+		info("No running QEMU guest with a hostfwd to port 22")
+		return
+	}
+
+	m := loadCache()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPID\tFORWARD\tCACHE")
+	for _, g := range guests {
+		name := g.Name
+		if name == "" {
+			name = "-"
+		}
+		state := "new"
+		if k, found := cachedGuest(m, g); found {
+			state = entryLine(k, m[k])
+		} else if e := guestEntry(g); e.Alias != "" {
+			if k, taken := findAlias(m, e.Alias); taken {
+				state = "alias " + e.Alias + " is " + k
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s:%d → 22\t%s\n", name, g.PID, g.Host, g.Port, state)
+	}
+	tw.Flush()
+	fmt.Println()
+	info("Connect with: ssh-forge --discover-qemu <name|port>  (or pick it in --menu)")
+}
+
+// sshUp reports whether sshd on e answers right now.
+func sshUp(e Entry, via []Entry) bool {
+	if len(via) > 0 {
+		return probeAuth(e, via).status != probeUnreachable
+	}
+	banner, _, err := readBanner(e, 2*time.Second)
+	return err == nil && strings.HasPrefix(banner, "SSH-")
+}
+
+// hostCommand prepares a start/stop command: run by sh with the target in
+// the environment and its output appended to the start log.
+func hostCommand(e Entry, command string) (*exec.Cmd, *os.File) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"SSH_FORGE_USER="+e.User,
+		"SSH_FORGE_HOST="+e.Host,
+		"SSH_FORGE_PORT="+strconv.Itoa(e.Port),
+		"SSH_FORGE_ALIAS="+e.Alias,
+	)
+	logf, err := os.OpenFile(startLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		die("Cannot open " + startLog + ": " + err.Error())
+	}
+	fmt.Fprintf(logf, "\n[%s] %s: %s\n", time.Now().Format(time.RFC3339), entryKey(e.User, e.Host, e.Port), command)
+	cmd.Stdout, cmd.Stderr = logf, logf
+	return cmd, logf
+}
+
+// startHost runs e's start command when its ssh port does not answer and
+// waits for the banner. The command may exit at once (virsh, docker) or
+// keep running (a QEMU launch script); it runs in its own session either
+// way so it outlives ssh-forge.
+func startHost(e Entry, via []Entry) {
+	if sshUp(e, via) {
+		return
+	}
+
+	info(targetName(e) + " is down — running: " + e.StartCmd)
+	cmd, logf := hostCommand(e, e.StartCmd)
+	defer logf.Close()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		die("Start command failed: " + err.Error())
+	}
+
+	failed := make(chan error, 1)
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			failed <- fmt.Errorf("start command failed (%v) — see %s", err, startLog)
+		}
+	}()
+
+	timeout := 5 * time.Minute
+	if v := setting("start_timeout", ""); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			timeout = d
+		}
+	}
+	if err := waitForSSH(e, timeout, failed); err != nil {
+		die(err.Error())
+	}
+}
+
+// checkMAC normalises a MAC address for Wake-on-LAN.
+func checkMAC(s string) (string, error) {
+	hw, err := net.ParseMAC(s)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid MAC address %q", s)
+	}
+	return hw.String(), nil
+}
+
+// checkWakeAddr validates a broadcast host[:port], defaulting to port 9.
+func checkWakeAddr(s string) (string, error) {
+	h, p, err := net.SplitHostPort(s)
+	if err != nil {
+		h, p = s, "9"
+	}
+	if net.ParseIP(h) == nil {
+		if err := checkHost(h); err != nil {
+			return "", err
+		}
+	}
+	if _, err := checkPort(p); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(h, p), nil
+}
+
+// sendMagicPacket broadcasts a Wake-on-LAN packet: six 0xff bytes and the
+// MAC sixteen times. It is sent a few times since UDP may drop it.
+func sendMagicPacket(mac, addr string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if addr == "" {
+		addr = "255.255.255.255:9"
+	}
+
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	for i := 0; i < 16; i++ {
+		packet = append(packet, hw...)
+	}
+
+	dst, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	// Unconnected, so an ICMP "port unreachable" from a sleeping host's
+	// NIC cannot fail the later sends.
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := conn.WriteTo(packet, dst); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// wakeHost sends the magic packet for e and waits for its ssh port.
+func wakeHost(e Entry, via []Entry, timeout time.Duration) {
+	addr := e.WakeAddr
+	if addr == "" {
+		addr = "255.255.255.255:9"
+	}
+	info("Waking " + targetName(e) + " (" + e.MAC + " via " + addr + ")")
+	if err := sendMagicPacket(e.MAC, addr); err != nil {
+		die("Cannot send Wake-on-LAN packet: " + err.Error())
+	}
+	if err := waitForSSH(e, timeout, nil); err != nil {
+		die(err.Error())
+	}
+}
+
+// wakeCommand handles --wake target [--timeout 5m].
+func wakeCommand(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		die("Usage: ssh-forge --wake target [--timeout 5m]")
+	}
+	k, e := mustCached(parse(args[0]))
+	if e.MAC == "" {
+		die(k + " has no MAC address — set one with: ssh-forge " + targetName(e) + " --mac aa:bb:cc:dd:ee:ff")
+	}
+	timeout := 5 * time.Minute
+	if v := flagValue(args, "--timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+			die("Invalid --timeout: " + v)
+		}
+	}
+
+	via := jumpChain(loadCache(), e)
+	if sshUp(e, via) {
+		ok(k + " is already up")
+		return
+	}
+	wakeHost(e, via, timeout)
+}
+
+// stopHost runs the stop command of a cached entry and waits for it.
+func stopHost(e Entry) {
+	k, cached := mustCached(e)
+	if cached.StopCmd == "" {
+		die(k + " has no stop command — set one with: ssh-forge " + targetName(cached) + " --stop-cmd '...'")
+	}
+
+	info("Stopping " + targetName(cached) + ": " + cached.StopCmd)
+	cmd, logf := hostCommand(cached, cached.StopCmd)
+	defer logf.Close()
+	cmd.Stdout = io.MultiWriter(os.Stdout, logf)
+	cmd.Stderr = io.MultiWriter(os.Stderr, logf)
+	if err := cmd.Run(); err != nil {
+		die("Stop command failed: " + err.Error())
+	}
+	ok("Stop command finished for " + k)
+}
+
+// readBanner connects to e's port and returns the first line the server
+// sends together with the TCP connect time. An empty banner is not an error.
+func readBanner(e Entry, timeout time.Duration) (string, time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(e.Host, strconv.Itoa(e.Port)), timeout)
+	if err != nil {
+		return "", 0, err
+	}
+	latency := time.Since(start)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	return strings.TrimSpace(line), latency, nil
+}
+
+// waitForSSH polls e until sshd answers or timeout passes (0 waits
+// forever), showing the elapsed time. Direct hosts must send an SSH banner;
+// hosts behind a jump chain must get as far as authentication. An error on
+// failed (nil when unused) ends the wait early.
+func waitForSSH(e Entry, timeout time.Duration, failed <-chan error) error {
+	via, err := resolveJumps(loadCache(), e)
+	if err != nil {
+		return err
+	}
+
+	target := entryKey(e.User, e.Host, e.Port)
+	start := time.Now()
+	last := "no answer yet"
+	for {
+		if len(via) == 0 {
+			banner, _, err := readBanner(e, 2*time.Second)
+			if err == nil && strings.HasPrefix(banner, "SSH-") {
+				break
+			}
+			if err != nil {
+				last = err.Error()
+			} else {
+				last = "port open, no SSH banner yet"
+			}
+		} else if p := probeAuth(e, via); p.status != probeUnreachable {
+			break
+		} else {
+			last = p.detail
+		}
+
+		elapsed := time.Since(start)
+		if timeout > 0 && elapsed >= timeout {
+			fmt.Println()
+			return fmt.Errorf("%s not up after %s (%s)", target, timeout, last)
+		}
+		fmt.Printf("\r\033[K%s⏳ Waiting for %s … %s%s", BLUE, target, elapsed.Round(time.Second), NC)
+		select {
+		case <-time.After(time.Second):
+		case err := <-failed:
+			fmt.Println()
+			return err
+		}
+	}
+	fmt.Print("\r\033[K")
+	ok(fmt.Sprintf("%s is up after %s", target, time.Since(start).Round(time.Second)))
+	return nil
+}
+
+// notify sends a desktop notification when notify-send is available and
+// rings the terminal bell either way.
+func notify(title, body string) {
+	fmt.Print("\a")
+	if _, err := exec.LookPath("notify-send"); err == nil {
+		exec.Command("notify-send", "-a", "ssh-forge", title, body).Run()
+	}
+}
+
+// pingHost measures TCP connect time, reads the SSH banner and checks that
+// key auth works without prompting. Hosts behind a jump chain are only
+// checked through ssh, since their port is not reachable from here.
+func pingHost(m map[string]Entry, k string) pingResult {
+	e := m[k]
+	r := pingResult{key: k}
+
+	via, err := resolveJumps(m, e)
+	if err != nil {
+		r.err = err.Error()
+		return r
+	}
+	if len(via) == 0 {
+		r.banner, r.latency, err = readBanner(e, 3*time.Second)
+		if err != nil {
+			r.err = err.Error()
+			return r
+		}
+		r.alive = true
+		if !strings.HasPrefix(r.banner, "SSH-") {
+			r.banner = "(no SSH banner)"
+			return r
+		}
+	} else {
+		r.banner = "(via " + jumpSpec(via) + ")"
+	}
+
+	r.auth = probeAuth(e, via)
+	if r.auth.status != probeUnreachable {
+		r.alive = true
+	} else if len(via) > 0 {
+		// Through a jump host ssh's own verdict is all we have.
+		r.err = r.auth.detail
+	}
+	return r
+}
+
+// pingAll probes the selected hosts with a bounded worker pool, prints a
+// table and records when each host went dead. With pruneDays > 0 it offers
+// to remove hosts that have been unreachable for that long.
+func pingAll(tag string, workers, pruneDays int, assumeYes bool) {
+	m := loadCache()
+	keys := sortedKeys(m, tag)
+	if len(keys) == 0 {
+		fmt.Println("(empty)")
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	info(fmt.Sprintf("Pinging %d host(s) with %d workers…", len(keys), workers))
+
+	results := make([]pingResult, len(keys))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = pingHost(m, keys[i])
+			}
+		}()
+	}
+	for i := range keys {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.alive != b.alive {
+			return a.alive
+		}
+		if a.alive && a.latency != b.latency {
+			// Hosts behind a jump have no direct latency; list them last.
+			if a.latency == 0 || b.latency == 0 {
+				return b.latency == 0
+			}
+			return a.latency < b.latency
+		}
+		return a.key < b.key
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tLATENCY\tBANNER\tKEY AUTH")
+	for _, r := range results {
+		latency, auth := "-", "-"
+		if r.latency > 0 {
+			latency = r.latency.Round(100 * time.Microsecond).String()
+		}
+		switch {
+		case !r.alive:
+		case r.auth.status == probeOK:
+			auth = "yes"
+		case r.auth.status == probeHostKey:
+			auth = "HOST KEY MISMATCH"
+		case r.auth.status == probeUnknownHostKey:
+			auth = "host key unknown"
+		case r.auth.status == probeAuthRefused && len(r.auth.methods) > 0:
+			auth = "no (" + strings.Join(r.auth.methods, ",") + ")"
+		default:
+			auth = "no"
+		}
+		banner := r.banner
+		if !r.alive {
+			banner = "DOWN: " + r.err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", entryLine(r.key, m[r.key]), latency, banner, auth)
+	}
+	tw.Flush()
+
+	now := time.Now().Unix()
+	updateCache(func(m map[string]Entry) bool {
+		changed := false
+		for _, r := range results {
+			e, found := m[r.key]
+			if !found {
+				continue
+			}
+			if r.alive && e.DeadSince != 0 {
+				e.DeadSince = 0
+			} else if !r.alive && e.DeadSince == 0 {
+				e.DeadSince = now
+			} else {
+				continue
+			}
+			m[r.key] = e
+			changed = true
+		}
+		return changed
+	})
+
+	if pruneDays <= 0 {
+		return
+	}
+
+	m = loadCache()
+	cutoff := now - int64(pruneDays)*86400
+	var dead []string
+	for _, r := range results {
+		if e, found := m[r.key]; found && !r.alive && e.DeadSince != 0 && e.DeadSince <= cutoff {
+			dead = append(dead, r.key)
+		}
+	}
+	if len(dead) == 0 {
+		ok(fmt.Sprintf("No host has been down for %d day(s)", pruneDays))
+		return
+	}
+
+	fmt.Println(YELLOW + fmt.Sprintf("Down for at least %d day(s):", pruneDays) + NC)
+	for _, k := range dead {
+		fmt.Println("  " + entryLine(k, m[k]) + "  · down since " + ago(m[k].DeadSince))
+	}
+	if !assumeYes && !confirm(fmt.Sprintf("Remove %d host(s)?", len(dead))) {
+		warn("Cancelled")
+		return
+	}
+
+	updateCache(func(m map[string]Entry) bool {
+		for _, k := range dead {
+			delete(m, k)
+		}
+		return true
+	})
+	for _, k := range dead {
+		forgetKnownHost(m[k].Host, m[k].Port)
+	}
+	ok(fmt.Sprintf("Pruned %d host(s)", len(dead)))
+}
+
+// hostLabel is the short name used in multi-host output.
+func hostLabel(k string, e Entry) string {
+	if e.Alias != "" {
+		return e.Alias
+	}
+	return k
+}
+
+// shellQuote wraps s in single quotes for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+type execResult struct {
+	key    string
+	output string
+	status string
+	failed bool
+}
+
+// scriptRunner uploads stdin to a temp file on the remote side, runs it
+// (its shebang decides the interpreter) and removes it again.
+const scriptRunner = `t=$(mktemp) && cat > "$t" && chmod +x "$t" && "$t"%s; rc=$?; rm -f "$t"; exit $rc`
+
+// execMany runs remoteCmd (or a local script) on keys with at most parallel
+// sessions at once. Output is streamed with a host prefix unless capture is
+// set; either way identical outputs are grouped in the final summary.
+func execMany(m map[string]Entry, keys []string, remoteCmd string, script []byte, parallel int, timeout time.Duration, capture bool) bool {
+	width := 0
+	for _, k := range keys {
+		if l := len(hostLabel(k, m[k])); l > width {
+			width = l
+		}
+	}
+
+	var mu sync.Mutex
+	results := make([]execResult, len(keys))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	for i, k := range keys {
+		wg.Add(1)
+		go func(i int, k string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			e := m[k]
+			res := execResult{key: k, status: "exit 0"}
+
+			via, err := resolveJumps(m, e)
+			if err != nil {
+				res.status, res.failed = err.Error(), true
+				results[i] = res
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			args := append([]string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}, sshOpts(e, via)...)
+			args = append(args, e.User+"@"+e.Host, remoteCmd)
+			cmd := exec.CommandContext(ctx, "ssh", args...)
+			cmd.WaitDelay = 2 * time.Second
+			if script != nil {
+				cmd.Stdin = bytes.NewReader(script)
+			}
+
+			pr, pw := io.Pipe()
+			cmd.Stdout = pw
+			cmd.Stderr = pw
+
+			var out strings.Builder
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				sc := bufio.NewScanner(pr)
+				sc.Buffer(make([]byte, 64*1024), 1024*1024)
+				prefix := fmt.Sprintf("%-*s | ", width, hostLabel(k, e))
+				for sc.Scan() {
+					out.WriteString(sc.Text() + "\n")
+					if !capture {
+						mu.Lock()
+						fmt.Println(BLUE + prefix + NC + sc.Text())
+						mu.Unlock()
+					}
+				}
+				io.Copy(io.Discard, pr)
+			}()
+
+			err = cmd.Run()
+			pw.Close()
+			<-done
+
+			res.output = out.String()
+			switch {
+			case ctx.Err() == context.DeadlineExceeded:
+				res.status, res.failed = "timeout after "+timeout.String(), true
+			case err != nil:
+				res.status, res.failed = err.Error(), true
+				if ee, isExit := err.(*exec.ExitError); isExit {
+					res.status = fmt.Sprintf("exit %d", ee.ExitCode())
+				}
+			}
+			results[i] = res
+
+			if capture {
+				mu.Lock()
+				fmt.Println(BLUE + "━━ " + hostLabel(k, e) + " (" + res.status + ")" + NC)
+				fmt.Print(res.output)
+				mu.Unlock()
+			}
+		}(i, k)
+	}
+	wg.Wait()
+
+	// Group hosts whose output and status are identical.
+	type group struct {
+		labels []string
+		res    execResult
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	failed := 0
+	for _, r := range results {
+		if r.failed {
+			failed++
+		}
+		id := r.status + "\x00" + r.output
+		g, seen := index[id]
+		if !seen {
+			g = &group{res: r}
+			index[id] = g
+			groups = append(groups, g)
+		}
+		g.labels = append(g.labels, hostLabel(r.key, m[r.key]))
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return len(groups[i].labels) > len(groups[j].labels) })
+
+	fmt.Println()
+	fmt.Println(BLUE + "━━ Summary ━━" + NC)
+	for _, g := range groups {
+		color := GREEN
+		if g.res.failed {
+			color = RED
+		}
+		fmt.Printf("%s%d host(s) — %s:%s %s\n", color, len(g.labels), g.res.status, NC, strings.Join(g.labels, ", "))
+		for _, line := range strings.Split(strings.TrimRight(g.res.output, "\n"), "\n") {
+			if line != "" {
+				fmt.Println("    " + line)
+			}
+		}
+	}
+
+	if failed > 0 {
+		warn(fmt.Sprintf("%d of %d host(s) failed", failed, len(results)))
+		return false
+	}
+	ok(fmt.Sprintf("Succeeded on all %d host(s)", len(results)))
+	return true
+}
+
+// execCommand parses: --exec [--tag t|--all] [--parallel N] [--timeout D]
+// [--capture] [--script file] -- command...
+func execCommand(args []string) {
+	opts, rest := args, []string(nil)
+	for i, a := range args {
+		if a == "--" {
+			opts, rest = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	scriptPath := flagValue(opts, "--script")
+	if len(rest) == 0 && scriptPath == "" {
+		die("Usage: ssh-forge --exec --tag tag|--all [--parallel N] [--timeout 30s] -- 'command'")
+	}
+
+	tag := flagValue(opts, "--tag")
+	if tag == "" && !hasFlag(opts, "--all") {
+		die("Select hosts with --tag tag or --all")
+	}
+
+	parallel := 8
+	if v := flagValue(opts, "--parallel"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			die("--parallel must be a positive number")
+		}
+		parallel = n
+	}
+
+	timeout := 60 * time.Second
+	if v := flagValue(opts, "--timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			die("Invalid --timeout (examples: 30s, 5m)")
+		}
+		timeout = d
+	}
+
+	remoteCmd := strings.Join(rest, " ")
+	var script []byte
+	if scriptPath != "" {
+		data, err := os.ReadFile(expandHome(scriptPath))
+		if err != nil {
+			die("Cannot read script: " + err.Error())
+		}
+		script = data
+		quoted := ""
+		for _, a := range rest {
+			quoted += " " + shellQuote(a)
+		}
+		remoteCmd = fmt.Sprintf(scriptRunner, quoted)
+	}
+
+	m := loadCache()
+	keys := sortedKeys(m, tag)
+	if len(keys) == 0 {
+		die("No hosts selected")
+	}
+
+	what := remoteCmd
+	if scriptPath != "" {
+		what = "script " + scriptPath
+	}
+	info(fmt.Sprintf("Running on %d host(s), %d at a time: %s", len(keys), parallel, what))
+
+	if !execMany(m, keys, remoteCmd, script, parallel, timeout, hasFlag(opts, "--capture")) {
+		os.Exit(1)
+	}
+}
+
+// entryFields returns e's JSON fields by name.
+func entryFields(e Entry) map[string]json.RawMessage {
+	fields := make(map[string]json.RawMessage)
+	data, _ := json.Marshal(e)
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// applyEdits returns cur with every field that differs between orig and
+// edited set to its edited value.
+func applyEdits(cur, orig, edited Entry) Entry {
+	before, after, out := entryFields(orig), entryFields(edited), entryFields(cur)
+	for name := range before {
+		if _, set := after[name]; !set {
+			delete(out, name)
+		}
+	}
+	for name, val := range after {
+		if !bytes.Equal(before[name], val) {
+			out[name] = val
+		}
+	}
+
+	var res Entry
+	data, _ := json.Marshal(out)
+	json.Unmarshal(data, &res)
+	return res
+}
+
+// editFlags change single fields with --edit; without any of them the
+// entry is opened in $EDITOR instead.
+var editFlags = []string{"--user", "--host", "--port", "--alias", "--note", "--key", "--jump", "--start-cmd", "--stop-cmd", "--mac", "--wake-addr", "--command", "--dir"}
+
+// editEntry changes a cached entry in place. When host, port or user change
+// the cache key moves with it, along with known_hosts lines and the jump
+// lists of other hosts that referenced the old key.
+func editEntry(e Entry, args []string) {
+	oldKey, edited := mustCached(e)
+	orig := edited
+	m := loadCache()
+
+	if hasFlag(args, editFlags...) {
+		if v := flagValue(args, "--user"); v != "" {
+			edited.User = v
+		}
+		if v := flagValue(args, "--host"); v != "" {
+			edited.Host = strings.Trim(v, "[]")
+		}
+		if v := flagValue(args, "--port"); v != "" {
+			p, err := checkPort(v)
+			if err != nil {
+				die("Invalid --port: " + err.Error())
+			}
+			edited.Port = p
+		}
+		if hasFlag(args, "--alias") {
+			edited.Alias = flagValue(args, "--alias")
+		}
+		if hasFlag(args, "--note") {
+			edited.Note = flagValue(args, "--note")
+		}
+		if hasFlag(args, "--command") {
+			edited.Command = flagValue(args, "--command")
+		}
+		if hasFlag(args, "--dir") {
+			edited.Dir = flagValue(args, "--dir")
+		}
+		if hasFlag(args, "--start-cmd") {
+			edited.StartCmd = flagValue(args, "--start-cmd")
+		}
+		if hasFlag(args, "--stop-cmd") {
+			edited.StopCmd = flagValue(args, "--stop-cmd")
+		}
+		if hasFlag(args, "--mac") {
+			edited.MAC = ""
+			if v := flagValue(args, "--mac"); v != "" {
+				mac, err := checkMAC(v)
+				if err != nil {
+					die(err.Error())
+				}
+				edited.MAC = mac
+			}
+		}
+		if hasFlag(args, "--wake-addr") {
+			edited.WakeAddr = ""
+			if v := flagValue(args, "--wake-addr"); v != "" {
+				addr, err := checkWakeAddr(v)
+				if err != nil {
+					die("Invalid --wake-addr: " + err.Error())
+				}
+				edited.WakeAddr = addr
+			}
+		}
+		if hasFlag(args, "--key") {
+			edited.Identity = ""
+			if v := flagValue(args, "--key"); v != "" {
+				edited.Identity = checkIdentity(v)
+			}
+		}
+		if hasFlag(args, "--jump") {
+			edited.Jump = nil
+			for _, ref := range splitList(flagValue(args, "--jump")) {
+				edited.Jump = append(edited.Jump, jumpRef(m, ref))
+			}
+		}
+		if err := checkEntry(m, oldKey, edited); err != nil {
+			die(err.Error())
+		}
+	} else {
+		edited = editInEditor(m, oldKey, edited)
+	}
+
+	newKey := entryKey(edited.User, edited.Host, edited.Port)
+	var old Entry
+	updateCache(func(m map[string]Entry) bool {
+		var found bool
+		if old, found = m[oldKey]; !found {
+			die("Entry not found: " + oldKey)
+		}
+		// Only the edited fields are applied, so stats and tunnels written
+		// meanwhile (e.g. by a session that just ended) are kept.
+		edited = applyEdits(old, orig, edited)
+		if err := checkEntry(m, oldKey, edited); err != nil {
+			die(err.Error())
+		}
+		delete(m, oldKey)
+		m[newKey] = edited
+
+		// Hosts that jump through this one follow it, whether they name
+		// it by key or by alias. A dropped alias becomes the full key.
+		newRef := hopRef(edited.User, edited.Host, edited.Port)
+		if edited.Alias != "" {
+			newRef = edited.Alias
+		}
+		for k, other := range m {
+			for i, ref := range other.Jump {
+				hop, isTarget := parseTarget(ref)
+				byKey := isTarget && entryKey(hop.User, hop.Host, hop.Port) == oldKey && newKey != oldKey
+				byAlias := !isTarget && old.Alias != "" && ref == old.Alias && edited.Alias != old.Alias
+				if byKey {
+					other.Jump[i] = hopRef(edited.User, edited.Host, edited.Port)
+				} else if byAlias {
+					other.Jump[i] = newRef
+				}
+				if byKey || byAlias {
+					m[k] = other
+				}
+			}
+		}
+		return true
+	})
+
+	if newKey != oldKey {
+		if old.Host != edited.Host || old.Port != edited.Port {
+			moveKnownHost(old.Host, old.Port, edited.Host, edited.Port)
+		}
+		ok("Renamed " + oldKey + " → " + newKey)
+	} else {
+		ok("Updated " + newKey)
+	}
+}
+
+// checkEntry validates an edited entry against the rest of the cache.
+func checkEntry(m map[string]Entry, oldKey string, e Entry) error {
+	if e.User == "" || strings.ContainsAny(e.User, " \t@:/") {
+		return fmt.Errorf("invalid user name %q", e.User)
+	}
+	// A host cached before validation existed is kept until it is changed.
+	if e.Host != m[oldKey].Host {
+		if err := checkHost(e.Host); err != nil {
+			return err
+		}
+	}
+	if e.Port < 1 || e.Port > 65535 {
+		return fmt.Errorf("port %d is out of range (1-65535)", e.Port)
+	}
+	k := entryKey(e.User, e.Host, e.Port)
+	if _, taken := m[k]; taken && k != oldKey {
+		return fmt.Errorf("%s is already cached", k)
+	}
+
+	if e.Alias != "" {
+		if !nameRe.MatchString(e.Alias) || reservedNames[e.Alias] {
+			return fmt.Errorf("invalid alias %q", e.Alias)
+		}
+		if other, found := findAlias(m, e.Alias); found && other != oldKey {
+			return fmt.Errorf("alias '%s' already used by %s", e.Alias, other)
+		}
+	}
+	for _, t := range e.Tags {
+		if !nameRe.MatchString(t) {
+			return fmt.Errorf("invalid tag %q", t)
+		}
+	}
+	if e.Identity != "" {
+		if _, err := os.Stat(e.Identity); err != nil {
+			return fmt.Errorf("identity not found: %s", e.Identity)
+		}
+	}
+	if e.MAC != "" {
+		if _, err := checkMAC(e.MAC); err != nil {
+			return err
+		}
+	}
+	if e.WakeAddr != "" {
+		if _, err := checkWakeAddr(e.WakeAddr); err != nil {
+			return fmt.Errorf("wake_addr: %v", err)
+		}
+	}
+	for name, f := range e.Tunnels {
+		if !nameRe.MatchString(name) {
+			return fmt.Errorf("invalid tunnel name %q", name)
+		}
+		if _, err := parseForward(f.String()); err != nil {
+			return fmt.Errorf("tunnel %s: %v", name, err)
+		}
+	}
+
+	// The jump chain is checked as it would be after the rename.
+	rest := make(map[string]Entry, len(m))
+	for k, v := range m {
+		if k != oldKey {
+			rest[k] = v
+		}
+	}
+	if _, err := resolveJumps(rest, e); err != nil {
+		return err
+	}
+	return nil
+}
+
+// editInEditor opens the entry as JSON in $EDITOR (vi if unset) and keeps
+// reopening it until the result is valid or the user gives up.
+func editInEditor(m map[string]Entry, oldKey string, e Entry) Entry {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	f, err := os.CreateTemp("", "ssh-forge-edit-*.json")
+	if err != nil {
+		die("Cannot create temp file: " + err.Error())
+	}
+	defer os.Remove(f.Name())
+	data, _ := json.MarshalIndent(e, "", "  ")
+	f.Write(append(data, '\n'))
+	f.Close()
+
+	for {
+		cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			die("Editor failed: " + err.Error())
+		}
+
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			die("Cannot read edited entry: " + err.Error())
+		}
+		var edited Entry
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&edited); err == nil {
+			if edited.Identity != "" {
+				edited.Identity = expandHome(edited.Identity)
+			}
+			sort.Strings(edited.Tags)
+			err = checkEntry(m, oldKey, edited)
+		}
+		if err == nil {
+			return edited
+		}
+
+		warn("Invalid entry: " + err.Error())
+		if !confirm("Edit again?") {
+			die("Nothing changed")
+		}
+	}
+}
+
+// moveKnownHost copies the known_hosts keys of the old name to the new one
+// (unless it already has some) and drops the old lines.
+func moveKnownHost(oldHost string, oldPort int, newHost string, newPort int) {
+	oldName, newName := knownHostName(oldHost, oldPort), knownHostName(newHost, newPort)
+	out, err := exec.Command("ssh-keygen", "-f", knownHosts, "-F", oldName).Output()
+	if err != nil {
+		return
+	}
+
+	if exec.Command("ssh-keygen", "-f", knownHosts, "-F", newName).Run() != nil {
+		var lines []string
+		for _, l := range strings.Split(string(out), "\n") {
+			// @cert-authority / @revoked lines are patterns, not this host.
+			fields := strings.Fields(l)
+			if len(fields) < 3 || strings.HasPrefix(l, "#") || strings.HasPrefix(l, "@") {
+				continue
+			}
+			lines = append(lines, newName+" "+strings.Join(fields[1:], " "))
+		}
+
+		f, err := os.OpenFile(knownHosts, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			warn("Cannot update known_hosts: " + err.Error())
+			return
+		}
+		for _, l := range lines {
+			fmt.Fprintln(f, l)
+		}
+		f.Close()
+	}
+
+	forgetKnownHost(oldHost, oldPort)
+	ok("Moved known_hosts entry " + oldName + " → " + newName)
+}
+
+// mustCached returns the cache key and stored entry for e, or dies.
+func mustCached(e Entry) (string, Entry) {
+	k := entryKey(e.User, e.Host, e.Port)
+	cached, found := loadCache()[k]
+	if !found {
+		die("Entry not found: " + k + " — connect once first")
+	}
+	return k, cached
+}
+
+var forwardPortRe = regexp.MustCompile(`^\d{1,5}$`)
+
+// parseForward accepts "L 5432:localhost:5432", "-L 5432:localhost:5432",
+// "R 8080:localhost:80" or "D 1080" (an optional bind address may lead).
+func parseForward(s string) (Forward, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Forward{}, fmt.Errorf("expected '<L|R|D> spec', got %q", s)
+	}
+	f := Forward{Kind: strings.ToUpper(strings.TrimPrefix(fields[0], "-")), Spec: fields[1]}
+
+	// Split on colons outside [ipv6] brackets.
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range f.Spec {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, f.Spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, f.Spec[start:])
+
+	checkPort := func(p string) error {
+		n, err := strconv.Atoi(p)
+		if !forwardPortRe.MatchString(p) || err != nil || n > 65535 {
+			return fmt.Errorf("invalid port %q in %s", p, f)
+		}
+		return nil
+	}
+
+	switch f.Kind {
+	case "L", "R":
+		if len(parts) != 3 && len(parts) != 4 {
+			return Forward{}, fmt.Errorf("%s needs [bind:]port:host:hostport", f.Kind)
+		}
+		if err := checkPort(parts[len(parts)-3]); err != nil {
+			return Forward{}, err
+		}
+		if err := checkPort(parts[len(parts)-1]); err != nil {
+			return Forward{}, err
+		}
+	case "D":
+		if len(parts) > 2 {
+			return Forward{}, fmt.Errorf("D needs [bind:]port")
+		}
+		if err := checkPort(parts[len(parts)-1]); err != nil {
+			return Forward{}, err
+		}
+	default:
+		return Forward{}, fmt.Errorf("forward type must be L, R or D, not %q", fields[0])
+	}
+	return f, nil
+}
+
+func listTunnels(k string, e Entry) {
+	if len(e.Tunnels) == 0 {
+		fmt.Println("(no tunnel profiles for " + k + ")")
+		return
+	}
+	names := make([]string, 0, len(e.Tunnels))
+	for n := range e.Tunnels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Printf("%-12s %s\n", n, e.Tunnels[n])
+	}
+}
+
+// editTunnel adds (fwd != "") or removes a named forward on a cached entry.
+func editTunnel(e Entry, name, fwd string) {
+	k := entryKey(e.User, e.Host, e.Port)
+	if !nameRe.MatchString(name) {
+		die("Invalid tunnel name '" + name + "'. Use letters, digits, '.', '_' or '-'")
+	}
+
+	var f Forward
+	if fwd != "" {
+		var err error
+		if f, err = parseForward(fwd); err != nil {
+			die("Invalid forward: " + err.Error())
+		}
+	}
+
+	updateCache(func(m map[string]Entry) bool {
+		cur, found := m[k]
+		if !found {
+			die("Entry not found: " + k + " — connect once first")
+		}
+		if fwd == "" {
+			if _, has := cur.Tunnels[name]; !has {
+				die("No tunnel profile '" + name + "' on " + k)
+			}
+			delete(cur.Tunnels, name)
+		} else {
+			if cur.Tunnels == nil {
+				cur.Tunnels = make(map[string]Forward)
+			}
+			cur.Tunnels[name] = f
+		}
+		m[k] = cur
+		return true
+	})
+
+	if fwd == "" {
+		ok("Removed tunnel " + name + " from " + k)
+	} else {
+		ok("Saved tunnel " + name + " on " + k + ": " + f.String())
+	}
+}
+
+// forwardArgs turns profile names into -L/-R/-D options.
+func forwardArgs(k string, e Entry, names []string) []string {
+	var args []string
+	for _, n := range names {
+		f, found := e.Tunnels[n]
+		if !found {
+			die("No tunnel profile '" + n + "' on " + k + " (see: ssh-forge " + hostLabel(k, e) + " --tunnel)")
+		}
+		args = append(args, "-"+f.Kind, f.Spec)
+	}
+	return args
+}
+
+// openTunnel runs only the named forwards (-N, no shell) in the foreground.
+func openTunnel(e Entry, names []string) {
+	k, cached := mustCached(e)
+	if len(names) == 0 {
+		listTunnels(k, cached)
+		return
+	}
+
+	args := append([]string{"-N", "-o", "ExitOnForwardFailure=yes", "-o", "ServerAliveInterval=30"}, forwardArgs(k, cached, names)...)
+	for _, n := range names {
+		info("Forwarding " + n + ": " + cached.Tunnels[n].String())
+	}
+	info("Ctrl-C to close the tunnel")
+	execSSH(cached, "", args...)
+}
+
+// tunnelState is the supervisor's record in ~/.ssh/ssh-forge-tunnels/<id>.json.
+type tunnelState struct {
+	ID        string  `json:"id"`
+	Target    string  `json:"target"`
+	Profile   string  `json:"profile"`
+	Forward   Forward `json:"forward"`
+	PID       int     `json:"pid"`
+	ChildPID  int     `json:"child_pid,omitempty"`
+	State     string  `json:"state"`
+	Started   int64   `json:"started"`
+	UpSince   int64   `json:"up_since,omitempty"`
+	Restarts  int     `json:"restarts"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+func tunnelID(k string, e Entry, profile string) string {
+	return unsafeHostChars.ReplaceAllString(hostLabel(k, e), "-") + "-" + profile
+}
+
+func tunnelPath(id, ext string) string {
+	return filepath.Join(tunnelDir, id+ext)
+}
+
+func readTunnel(id string) (tunnelState, bool) {
+	var st tunnelState
+	data, err := os.ReadFile(tunnelPath(id, ".json"))
+	if err != nil || json.Unmarshal(data, &st) != nil {
+		return st, false
+	}
+	return st, true
+}
+
+func writeTunnel(st tunnelState) {
+	data, _ := json.MarshalIndent(st, "", "  ")
+	writeFileSync(tunnelPath(st.ID, ".json"), data, 0600)
+}
+
+func pidAlive(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
+
+// tunnelUp starts one detached supervisor per profile. setsid puts it in
+// its own session, so closing the terminal or GUI tab does not kill it.
+func tunnelUp(e Entry, profiles []string) {
+	k, cached := mustCached(e)
+	forwardArgs(k, cached, profiles)
+	os.MkdirAll(tunnelDir, 0700)
+
+	self, err := os.Executable()
+	if err != nil {
+		die("Cannot locate ssh-forge binary: " + err.Error())
+	}
+
+	for _, p := range profiles {
+		id := tunnelID(k, cached, p)
+		if st, found := readTunnel(id); found && pidAlive(st.PID) {
+			warn(id + " already running (pid " + strconv.Itoa(st.PID) + ")")
+			continue
+		}
+
+		logFile, err := os.OpenFile(tunnelPath(id, ".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			die("Cannot open tunnel log: " + err.Error())
+		}
+
+		cmd := exec.Command(self, "--tunnel-supervise", k, p)
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		if err := cmd.Start(); err != nil {
+			die("Cannot start supervisor: " + err.Error())
+		}
+		logFile.Close()
+		pid := cmd.Process.Pid
+		cmd.Process.Release()
 
-func die(msg string) {
-	fmt.Println(RED + "❌ " + msg + NC)
-	os.Exit(1)
-}
-func ok(msg string)   { fmt.Println(GREEN + "✅ " + msg + NC) }
-func warn(msg string) { fmt.Println(YELLOW + "⚠️ " + msg + NC) }
-func info(msg string) { fmt.Println(BLUE + "ℹ️ " + msg + NC) }
+		// The supervisor owns the state file; wait briefly for its first write.
+		state := "starting"
+		for i := 0; i < 20; i++ {
+			if st, found := readTunnel(id); found && st.PID == pid {
+				state = st.State
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
 
-func need(cmd string) {
-	if _, err := exec.LookPath(cmd); err != nil {
-		die(cmd + " not installed")
+		ok(fmt.Sprintf("%s %s (%s, pid %d) — log: %s", id, state, cached.Tunnels[p], pid, tunnelPath(id, ".log")))
 	}
 }
 
-func initSSH() {
-	os.MkdirAll(filepath.Join(home, ".ssh"), 0700)
-	os.Chmod(filepath.Join(home, ".ssh"), 0700)
+// superviseTunnel keeps one forward alive: it restarts ssh with exponential
+// backoff (1s … 60s, reset after a minute of uptime) until told to stop.
+func superviseTunnel(k, profile string) {
+	m := loadCache()
+	e, found := m[k]
+	if !found {
+		die("Entry not found: " + k)
+	}
+	fwd := forwardArgs(k, e, []string{profile})
+	id := tunnelID(k, e, profile)
 
-	need("ssh")
+	st := tunnelState{
+		ID: id, Target: k, Profile: profile, Forward: e.Tunnels[profile],
+		PID: os.Getpid(), State: "starting", Started: time.Now().Unix(),
+	}
+	writeTunnel(st)
 
-	if _, err := os.Stat(cache); os.IsNotExist(err) {
-		if err := os.WriteFile(cache, []byte("{}"), 0644); err != nil {
-			die("Failed to create cache file")
+	signal.Ignore(syscall.SIGHUP)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	var mu sync.Mutex
+	stopping := false
+	stop := make(chan struct{})
+	var child *os.Process
+	go func() {
+		<-sigs
+		mu.Lock()
+		stopping = true
+		if child != nil {
+			child.Signal(syscall.SIGTERM)
 		}
-	}
+		mu.Unlock()
+		close(stop)
+	}()
 
-	data, _ := os.ReadFile(cache)
-	var tmp map[string]Entry
-	if json.Unmarshal(data, &tmp) != nil {
-		warn("Cache corrupted — resetting")
-		os.WriteFile(cache, []byte("{}"), 0644)
-	}
+	backoff := time.Second
+	for {
+		via, err := resolveJumps(m, e)
+		if err != nil {
+			st.State, st.LastError = "failed", err.Error()
+			writeTunnel(st)
+			os.Exit(1)
+		}
 
-	if _, err := os.Stat(key); os.IsNotExist(err) {
-		info("Generating SSH key...")
-		cmd := exec.Command("ssh-keygen", "-t", "ed25519", "-f", key, "-N", "")
-		cmd.Stdin = os.Stdin
+		args := []string{"-N", "-o", "BatchMode=yes", "-o", "ExitOnForwardFailure=yes",
+			"-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3"}
+		args = append(args, sshOpts(e, via)...)
+		args = append(args, fwd...)
+		args = append(args, e.User+"@"+e.Host)
+
+		var stderr bytes.Buffer
+		cmd := exec.Command("ssh", args...)
 		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			die("Keygen failed")
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+
+		mu.Lock()
+		if stopping {
+			mu.Unlock()
+			break
 		}
-	}
+		started := time.Now()
+		err = cmd.Start()
+		if err == nil {
+			child = cmd.Process
+			st.ChildPID, st.State, st.UpSince = cmd.Process.Pid, "up", started.Unix()
+			writeTunnel(st)
+		}
+		mu.Unlock()
 
-	if _, err := os.Stat(key + ".pub"); err != nil {
-		die("Public key missing")
+		if err == nil {
+			err = cmd.Wait()
+		}
+
+		mu.Lock()
+		child = nil
+		done := stopping
+		mu.Unlock()
+		if done {
+			break
+		}
+
+		st.Restarts++
+		st.ChildPID, st.UpSince, st.State = 0, 0, "restarting"
+		st.LastError = strings.TrimSpace(stderr.String())
+		if i := strings.LastIndex(st.LastError, "\n"); i >= 0 {
+			st.LastError = st.LastError[i+1:]
+		}
+		if st.LastError == "" && err != nil {
+			st.LastError = err.Error()
+		}
+		writeTunnel(st)
+
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		fmt.Printf("[%s] ssh exited (%s) — restarting in %s\n", time.Now().Format(time.RFC3339), st.LastError, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
 	}
 
-	os.Chmod(key, 0600)
-	ok("Key permission fixed (600)")
+	os.Remove(tunnelPath(id, ".json"))
+	fmt.Printf("[%s] stopped\n", time.Now().Format(time.RFC3339))
 }
 
-func loadCache() map[string]Entry {
-	data, _ := os.ReadFile(cache)
-	var m map[string]Entry
-	json.Unmarshal(data, &m)
-	if m == nil {
-		m = make(map[string]Entry)
+func listTunnelStates() []tunnelState {
+	files, _ := filepath.Glob(tunnelPath("*", ".json"))
+	sort.Strings(files)
+	var out []tunnelState
+	for _, f := range files {
+		if st, found := readTunnel(strings.TrimSuffix(filepath.Base(f), ".json")); found {
+			out = append(out, st)
+		}
 	}
-	return m
+	return out
 }
 
-func saveCache(m map[string]Entry) {
-	data, err := json.MarshalIndent(m, "", "  ")
-	if err != nil {
-		die("Failed to marshal cache")
+// tunnelDown stops supervisors: all, all for one host, or selected profiles.
+func tunnelDown(args []string) {
+	var ids []string
+	switch {
+	case hasFlag(args, "--all"):
+		for _, st := range listTunnelStates() {
+			ids = append(ids, st.ID)
+		}
+	case len(args) >= 1:
+		k, cached := mustCached(parse(args[0]))
+		if len(args) >= 2 {
+			for _, p := range splitList(args[1]) {
+				ids = append(ids, tunnelID(k, cached, p))
+			}
+		} else {
+			for _, st := range listTunnelStates() {
+				if st.Target == k {
+					ids = append(ids, st.ID)
+				}
+			}
+		}
+	default:
+		die("Usage: ssh-forge tunnel down target [profile[,profile]] | --all")
 	}
 
-	if err := os.WriteFile(cache+".tmp", data, 0644); err != nil {
-		die("Failed to write cache")
+	if len(ids) == 0 {
+		info("No tunnels running")
+		return
 	}
 
-	if err := os.Rename(cache+".tmp", cache); err != nil {
-		die("Failed to rename cache file")
+	for _, id := range ids {
+		st, found := readTunnel(id)
+		if !found {
+			warn(id + " is not running")
+			continue
+		}
+		if pidAlive(st.PID) {
+			syscall.Kill(st.PID, syscall.SIGTERM)
+			for i := 0; i < 50 && pidAlive(st.PID); i++ {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		if pidAlive(st.ChildPID) {
+			syscall.Kill(st.ChildPID, syscall.SIGTERM)
+		}
+		os.Remove(tunnelPath(id, ".json"))
+		ok(id + " stopped")
 	}
 }
 
-func parse(input string) (string, string, int) {
-	ipv6 := regexp.MustCompile(`^([^@]+)@\[(.+)\]:(\d+)$`)
-	ipv4 := regexp.MustCompile(`^([^@]+)@([^:]+):(\d+)$`)
+func tunnelStatus() {
+	states := listTunnelStates()
+	if len(states) == 0 {
+		fmt.Println("(no tunnels)")
+		return
+	}
 
-	if m := ipv6.FindStringSubmatch(input); m != nil {
-		p, err := strconv.Atoi(m[3])
-		if err != nil {
-			die("Invalid port number")
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TUNNEL\tFORWARD\tSTATE\tUPTIME\tRESTARTS\tLAST ERROR")
+	for _, st := range states {
+		state, uptime := st.State, "-"
+		if !pidAlive(st.PID) {
+			state = "dead"
+		} else if st.UpSince > 0 {
+			uptime = now.Sub(time.Unix(st.UpSince, 0)).Round(time.Second).String()
+		}
+		lastErr := st.LastError
+		if lastErr == "" {
+			lastErr = "-"
 		}
-		return m[1], m[2], p
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", st.ID, st.Forward, state, uptime, st.Restarts, lastErr)
 	}
-	if m := ipv4.FindStringSubmatch(input); m != nil {
-		p, err := strconv.Atoi(m[3])
-		if err != nil {
-			die("Invalid port number")
+	tw.Flush()
+}
+
+func tunnelCommand(args []string) {
+	if len(args) == 0 {
+		die("Usage: ssh-forge tunnel up|down|status")
+	}
+	switch args[0] {
+	case "up":
+		if len(args) < 3 {
+			die("Usage: ssh-forge tunnel up target profile[,profile]")
 		}
-		return m[1], m[2], p
+		tunnelUp(parse(args[1]), splitList(args[2]))
+	case "down":
+		tunnelDown(args[1:])
+	case "status":
+		tunnelStatus()
+	default:
+		die("Usage: ssh-forge tunnel up|down|status")
 	}
-	die("Invalid format. Use: user@ip:port or user@[ipv6]:port")
-	return "", "", 0
 }
 
-func execSSH(user, host string, port int) {
-	sshHost := host
-	if strings.Contains(host, ":") {
-		sshHost = "[" + host + "]"
+// persistSession keeps an interactive session alive across dropped links.
+// ssh exits with 255 when the connection itself fails; anything else is
+// the remote shell's own exit and ends the loop. attach, when set, is a
+// remote command such as "tmux new-session -A -s work" run on every
+// (re)connect. retries limits consecutive failures; 0 means no limit.
+func persistSession(e Entry, retries int, attach string) {
+	e, registered := register(e)
+	if !registered {
+		return
 	}
 
+	if attach == "" {
+		attach = remoteCommand(e)
+	}
+	args := sshArgs(e, attach, "-o", "ServerAliveInterval=15", "-o", "ServerAliveCountMax=3")
 	binary, _ := exec.LookPath("ssh")
-	args := []string{"ssh", "-p", strconv.Itoa(port), user + "@" + sshHost}
 
-	info("Connecting to " + user + "@" + host + ":" + strconv.Itoa(port) + " …")
-	syscall.Exec(binary, args, os.Environ())
-}
+	// Ctrl-C reaches ssh through the terminal; here it only cancels a
+	// pending reconnect.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT)
+	defer signal.Stop(sigs)
 
-// --raw: cache ছাড়া সরাসরি ssh -p <port> <user@host>
-func rawConnect(user, host string, port int) {
-	info("Raw connect (no cache) → " + user + "@" + host + ":" + strconv.Itoa(port))
-	execSSH(user, host, port)
-}
+	target := entryKey(e.User, e.Host, e.Port)
+	backoff, failures := time.Second, 0
+	for {
+		info("Connecting to " + target + " …")
+		cmd := exec.Command(binary, args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		started := time.Now()
+		err := cmd.Run()
 
-func connect(user, host string, port int) {
-	m := loadCache()
-	keyStr := fmt.Sprintf("%s@%s:%d", user, host, port)
+		code := 0
+		if exitErr, isExit := err.(*exec.ExitError); isExit {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			die("Cannot start ssh: " + err.Error())
+		}
+		if code != 255 {
+			os.Exit(code)
+		}
+
+		if time.Since(started) > time.Minute {
+			backoff, failures = time.Second, 0
+		}
+		failures++
+		if retries > 0 && failures > retries {
+			die(fmt.Sprintf("Connection to %s lost — giving up after %d retries", target, retries))
+		}
 
-	if _, exists := m[keyStr]; !exists {
+		// A Ctrl-C meant for the session must not cancel the countdown.
+		select {
+		case <-sigs:
+		default:
+		}
 
-		info("First time connecting — checking key authentication...")
+		limit := "∞"
+		if retries > 0 {
+			limit = strconv.Itoa(retries)
+		}
+		for left := int(backoff.Seconds()); left > 0; left-- {
+			fmt.Printf("\r%s⟳ Connection lost — reconnecting in %2ds (attempt %d/%s, Ctrl-C to stop)%s", YELLOW, left, failures, limit, NC)
+			select {
+			case <-time.After(time.Second):
+			case <-sigs:
+				fmt.Println()
+				warn("Reconnect cancelled")
+				os.Exit(255)
+			}
+		}
+		fmt.Print("\r\033[K")
+
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+// ioctl is a thin wrapper for the terminal requests the recorder needs.
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
 
-		test := exec.CommandContext(ctx,
-			"ssh",
-			"-o", "ConnectTimeout=5",
-			"-p", strconv.Itoa(port),
-			user+"@"+host,
-			"exit",
-		)
+type winsize struct{ Row, Col, X, Y uint16 }
 
-		if err := test.Run(); err != nil {
+// openPTY allocates a pseudo-terminal pair through /dev/ptmx.
+func openPTY() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
 
-			info("Key not installed — installing SSH key...")
+// makeRaw switches fd to raw mode and returns the settings to restore.
+func makeRaw(fd uintptr) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, unsafe.Pointer(&old)); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, unsafe.Pointer(&raw)); err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
 
-			copyCmd := exec.Command(
-				"ssh-copy-id",
-				"-i", key+".pub",
-				"-o", "StrictHostKeyChecking=no",
-				"-p", strconv.Itoa(port),
-				user+"@"+host,
-			)
+// castWriter appends asciicast v2 events. Output is cut on UTF-8
+// boundaries so a character split across two reads stays intact.
+type castWriter struct {
+	f       *os.File
+	start   time.Time
+	pending []byte
+}
 
-			copyCmd.Stdin = os.Stdin
-			copyCmd.Stdout = os.Stdout
-			copyCmd.Stderr = os.Stderr
+func (c *castWriter) event(kind, data string) {
+	line, _ := json.Marshal([]interface{}{
+		float64(time.Since(c.start).Microseconds()) / 1e6, kind, data,
+	})
+	c.f.Write(append(line, '\n'))
+}
 
-			if err := copyCmd.Run(); err != nil {
-				warn("Key copy failed — host not added to cache")
-				return
+func (c *castWriter) output(b []byte) {
+	c.pending = append(c.pending, b...)
+	cut := len(c.pending)
+	for i := len(c.pending) - 1; i >= 0 && i >= len(c.pending)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(c.pending[i]) {
+			if !utf8.FullRune(c.pending[i:]) {
+				cut = i
 			}
-
-			ok("Key copied successfully")
-		} else {
-			ok("Key authentication already working")
+			break
 		}
+	}
+	if cut > 0 {
+		c.event("o", string(c.pending[:cut]))
+		c.pending = append(c.pending[:0], c.pending[cut:]...)
+	}
+}
 
-		m[keyStr] = Entry{user, host, port}
-		saveCache(m)
-		ok("Host registered")
+// recordSession runs the ssh session under a local PTY and writes every
+// byte the user sees to an asciicast v2 file. Keystrokes are not stored,
+// so passwords typed at prompts stay out of the recording.
+func recordSession(e Entry) {
+	stdin := os.Stdin.Fd()
+	var size winsize
+	if err := ioctl(stdin, syscall.TIOCGWINSZ, unsafe.Pointer(&size)); err != nil {
+		die("--record needs an interactive terminal")
+	}
+	if size.Col == 0 || size.Row == 0 {
+		size.Col, size.Row = 80, 24
 	}
 
-	execSSH(user, host, port)
-}
+	e, registered := register(e)
+	if !registered {
+		return
+	}
 
-func remove(user, host string, port int) {
-	m := loadCache()
-	keyStr := fmt.Sprintf("%s@%s:%d", user, host, port)
+	dir := expandHome(setting("record_dir", recordDir))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		die("Cannot create " + dir + ": " + err.Error())
+	}
+	label := strings.NewReplacer("@", "_", ":", "_", "/", "_").Replace(targetName(e))
+	path := filepath.Join(dir, label+"-"+time.Now().Format("20060102-150405")+".cast")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		die("Cannot create recording: " + err.Error())
+	}
+	defer f.Close()
 
-	if _, ok := m[keyStr]; !ok {
-		die("Entry not found")
+	master, slave, err := openPTY()
+	if err != nil {
+		die("Cannot allocate a pseudo-terminal: " + err.Error())
 	}
+	ioctl(master.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&size))
 
-	if strings.Contains(host, ":") {
-		exec.Command("ssh-keygen", "-R",
-			fmt.Sprintf("[%s]:%d", host, port)).Run()
-	} else {
-		exec.Command("ssh-keygen", "-R",
-			fmt.Sprintf("%s:%d", host, port)).Run()
+	args := sshArgs(e, remoteCommand(e))
+	binary, _ := exec.LookPath("ssh")
+	cmd := exec.Command(binary, args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+
+	header, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     size.Col,
+		"height":    size.Row,
+		"timestamp": time.Now().Unix(),
+		"title":     "ssh-forge " + entryKey(e.User, e.Host, e.Port),
+		"env":       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	})
+	f.Write(append(header, '\n'))
+	cast := &castWriter{f: f, start: time.Now()}
+
+	info("Recording to " + path)
+	info("Connecting to " + entryKey(e.User, e.Host, e.Port) + " …")
+	if err := cmd.Start(); err != nil {
+		die("Cannot start ssh: " + err.Error())
 	}
+	slave.Close()
 
-	ok("Removed known_host entry")
+	oldState, err := makeRaw(stdin)
+	if err != nil {
+		cmd.Process.Kill()
+		die("Cannot switch the terminal to raw mode: " + err.Error())
+	}
 
-	delete(m, keyStr)
-	saveCache(m)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			if ioctl(stdin, syscall.TIOCGWINSZ, unsafe.Pointer(&size)) == nil {
+				ioctl(master.Fd(), syscall.TIOCSWINSZ, unsafe.Pointer(&size))
+				cast.event("r", fmt.Sprintf("%dx%d", size.Col, size.Row))
+			}
+		}
+	}()
+	go io.Copy(master, os.Stdin)
 
-	ok("Removed entry from ssh-forge cache")
+	// Reads end with EIO once ssh and everything it started have exited.
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := master.Read(buf)
+		if n > 0 {
+			os.Stdout.Write(buf[:n])
+			cast.output(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(cast.pending) > 0 {
+		cast.event("o", string(cast.pending))
+	}
+
+	cmd.Wait()
+	signal.Stop(winch)
+	ioctl(stdin, syscall.TCSETS, unsafe.Pointer(oldState))
+	master.Close()
+
+	fmt.Println()
+	ok("Session saved to " + path)
+	f.Close()
+	os.Exit(cmd.ProcessState.ExitCode())
 }
 
-func list() {
-	m := loadCache()
-	if len(m) == 0 {
-		fmt.Println("(empty)")
+// listRecordings prints the recordings in record_dir, newest first.
+func listRecordings() {
+	dir := expandHome(setting("record_dir", recordDir))
+	files, _ := filepath.Glob(filepath.Join(dir, "*.cast"))
+	if len(files) == 0 {
+		fmt.Println("(no recordings in " + dir + ")")
 		return
 	}
-	for k := range m {
-		fmt.Println(k)
+	sort.SliceStable(files, func(i, j int) bool {
+		a, _ := os.Stat(files[i])
+		b, _ := os.Stat(files[j])
+		return a != nil && b != nil && a.ModTime().After(b.ModTime())
+	})
+	for _, f := range files {
+		fmt.Println(f)
 	}
 }
 
-func fzfMenu() {
-	need("fzf")
-
-	m := loadCache()
-	if len(m) == 0 {
-		fmt.Println("(empty)")
-		return
+// replay plays an asciicast v2 file back on this terminal. speed divides
+// the recorded delays; maxIdle, when set, caps any single pause.
+func replay(path string, speed float64, maxIdle time.Duration) {
+	f, err := os.Open(expandHome(path))
+	if err != nil {
+		die("Cannot open recording: " + err.Error())
+	}
+	defer f.Close()
+	if speed <= 0 {
+		die("--speed must be greater than 0")
 	}
 
-	var sb strings.Builder
-	for k := range m {
-		sb.WriteString(k + "\n")
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !sc.Scan() {
+		die("Empty recording: " + path)
+	}
+	var header struct {
+		Version int `json:"version"`
+		Width   int `json:"width"`
+		Height  int `json:"height"`
+	}
+	if err := json.Unmarshal(sc.Bytes(), &header); err != nil || header.Version != 2 {
+		die("Not an asciicast v2 file: " + path)
+	}
+	var size winsize
+	if ioctl(os.Stdout.Fd(), syscall.TIOCGWINSZ, unsafe.Pointer(&size)) == nil &&
+		(int(size.Col) < header.Width || int(size.Row) < header.Height) {
+		warn(fmt.Sprintf("Recorded at %dx%d, this terminal is %dx%d", header.Width, header.Height, size.Col, size.Row))
 	}
 
-	cmd := exec.Command("fzf", "--prompt=SSH > ")
-	cmd.Stdin = strings.NewReader(sb.String())
+	prev := 0.0
+	for sc.Scan() {
+		var ev []interface{}
+		if json.Unmarshal(sc.Bytes(), &ev) != nil || len(ev) != 3 {
+			continue
+		}
+		t, _ := ev[0].(float64)
+		kind, _ := ev[1].(string)
+		data, _ := ev[2].(string)
 
-	out, err := cmd.Output()
-	if err != nil {
-		os.Exit(0)
-	}
+		wait := time.Duration((t - prev) / speed * float64(time.Second))
+		if maxIdle > 0 && wait > maxIdle {
+			wait = maxIdle
+		}
+		time.Sleep(wait)
+		prev = t
 
-	selected := strings.TrimSpace(string(out))
-	if selected == "" {
-		return
+		if kind == "o" {
+			os.Stdout.WriteString(data)
+		}
 	}
-
-	user, host, port := parse(selected)
-	connect(user, host, port)
+	fmt.Println()
+	ok("Replay finished")
 }
 
 func help() {
@@ -277,8 +4361,86 @@ func help() {
 USAGE:
   ssh-forge user@ip:port
   ssh-forge user@[ipv6]:port
-  ssh-forge user@ip:port --remove
-  ssh-forge --raw user@ip:port
+  ssh-forge host | user@host | host:port | ssh://user@host:port
+  ssh-forge target --remove
+  ssh-forge target --alias name
+  ssh-forge target --key ~/.ssh/other_key
+  ssh-forge target --jump bastion[,hop2]
+  ssh-forge target --tag add|remove tag[,tag]
+  ssh-forge target --ephemeral [--ttl 7d]      (re-created VMs: refresh host key, expire)
+  ssh-forge target --start-cmd 'virsh start dev' [--stop-cmd 'virsh shutdown dev']
+  ssh-forge --stop target
+  ssh-forge target --dir /srv/app [--command 'tmux new -A -s main']
+  ssh-forge target -- command [args]           (one-off, exit code passed through)
+  ssh-forge target --mac aa:bb:cc:dd:ee:ff [--wake-addr 192.168.1.255[:9]]
+  ssh-forge --wake target [--timeout 5m]
+  ssh-forge --raw target
+
+  Missing user/port default to default_user / default_port in
+  ~/.ssh/ssh-forge.toml (else the local user and 22).
+
+ALIAS:
+  ssh-forge name
+  ssh-forge name --remove
+
+TUNNELS:
+  ssh-forge name --tunnel                      (list profiles)
+  ssh-forge name --tunnel db[,socks]           (open, no shell)
+  ssh-forge name --tunnel-add db 'L 5432:localhost:5432'
+  ssh-forge name --tunnel-add socks 'D 1080'
+  ssh-forge name --tunnel-rm db
+
+BACKGROUND TUNNELS:
+  ssh-forge tunnel up name db[,socks]
+  ssh-forge tunnel down name [db] | --all
+  ssh-forge tunnel status
+
+MULTI-HOST:
+  ssh-forge --exec --tag tag|--all [--parallel N] [--timeout 30s] [--capture] -- 'command'
+  ssh-forge --exec --tag tag|--all --script local.sh [-- args]
+
+QEMU:
+  ssh-forge --discover-qemu                    (list running guests and their ports)
+  ssh-forge --discover-qemu vm-name|port       (connect, alias = VM name)
+
+WAIT FOR BOOT:
+  ssh-forge --wait name                        (poll until sshd answers, then connect)
+  ssh-forge --wait --timeout 10m --notify --no-connect name
+
+RECONNECT:
+  ssh-forge --persist name [--retries N]       (0 = retry forever, default 10)
+  ssh-forge --persist name --tmux work         (or --screen work)
+
+RECORDING:
+  ssh-forge --record name                      (asciicast v2 in record_dir)
+  ssh-forge --replay                           (list recordings)
+  ssh-forge --replay file.cast [--speed 2] [--max-idle 1s]
+
+HOST KEYS:
+  ssh-forge name --accept-new-hostkey          (re-pin after a reinstall)
+
+EDIT:
+  ssh-forge --edit name                          (open the entry in $EDITOR)
+  ssh-forge --edit name --port 2222 --note 'moved to new NAT'
+  ssh-forge --edit name --user u --host h --alias a --key path --jump hops
+
+HEALTH:
+  ssh-forge --ping [--tag tag] [--workers N]
+  ssh-forge --ping --prune-dead DAYS [--yes]
+
+HISTORY:
+  ssh-forge --last
+  ssh-forge --list --sort recent|frequent|name
+
+TAGS:
+  ssh-forge --list [--tag tag]
+  ssh-forge --menu [--tag tag]
+  ssh-forge --remove --tag tag
+
+IMPORT / EXPORT:
+  ssh-forge --import-ssh-config [path] [--yes]
+  ssh-forge --export-ssh-config [path|-]
+  ssh-forge --export-ssh-config --auto on|off
 
 OTHER:
   ssh-forge --list
@@ -305,6 +4467,15 @@ func doctor() {
 	} else {
 		warn("SSH key missing")
 	}
+
+	m := loadCache()
+	for _, k := range sortedKeys(m, "") {
+		if id := m[k].Identity; id != "" {
+			if _, err := os.Stat(id); err != nil {
+				warn(k + ": identity missing (" + id + ")")
+			}
+		}
+	}
 }
 
 func main() {
@@ -321,23 +4492,252 @@ func main() {
 	case "--version", "-v", "version":
 		fmt.Println("ssh-forge v" + VERSION)
 	case "--list":
-		list()
+		list(flagValue(os.Args[2:], "--tag"), flagValue(os.Args[2:], "--sort"))
+	case "--last":
+		connectLast()
+	case "tunnel":
+		tunnelCommand(os.Args[2:])
+	case "--tunnel-supervise":
+		if len(os.Args) < 4 {
+			die("internal: --tunnel-supervise target profile")
+		}
+		superviseTunnel(os.Args[2], os.Args[3])
+	case "--exec":
+		execCommand(os.Args[2:])
+	case "--ping":
+		args := os.Args[2:]
+		workers, pruneDays := 8, 0
+		if v := flagValue(args, "--workers"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				die("--workers must be a positive number")
+			}
+			workers = n
+		}
+		if v := flagValue(args, "--prune-dead"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				die("--prune-dead takes a number of days")
+			}
+			pruneDays = n
+		}
+		pingAll(flagValue(args, "--tag"), workers, pruneDays, hasFlag(args, "--yes", "-y"))
 	case "--menu":
-		fzfMenu()
+		fzfMenu(flagValue(os.Args[2:], "--tag"))
+	case "--remove":
+		tag := flagValue(os.Args[2:], "--tag")
+		if tag == "" {
+			die("Usage: ssh-forge --remove --tag tag  (or: ssh-forge target --remove)")
+		}
+		removeTagged(tag)
+	case "--import-ssh-config":
+		path := ""
+		if len(os.Args) > 2 && !strings.HasPrefix(os.Args[2], "-") {
+			path = os.Args[2]
+		}
+		importSSHConfig(path, hasFlag(os.Args[2:], "--yes", "-y"))
+	case "--export-ssh-config":
+		exportCommand(os.Args[2:])
+	case "--edit":
+		if len(os.Args) < 3 {
+			die("Usage: ssh-forge --edit target [--user u] [--host h] [--port p] [--alias a] [--note text]")
+		}
+		editEntry(parse(os.Args[2]), os.Args[3:])
+	case "--wake":
+		wakeCommand(os.Args[2:])
+	case "--stop":
+		if len(os.Args) < 3 {
+			die("Usage: ssh-forge --stop target")
+		}
+		stopHost(parse(os.Args[2]))
+	case "--discover-qemu":
+		discoverCommand(os.Args[2:])
+	case "--wait":
+		args := os.Args[2:]
+		var target string
+		for i := 0; i < len(args); i++ {
+			switch a := args[i]; {
+			case a == "--timeout":
+				i++
+			case !strings.HasPrefix(a, "-") && target == "":
+				target = a
+			}
+		}
+		if target == "" {
+			die("Usage: ssh-forge --wait [--timeout 5m] [--notify] [--no-connect] target")
+		}
+		timeout := 5 * time.Minute
+		if v := flagValue(args, "--timeout"); v != "" {
+			var err error
+			if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+				die("Invalid --timeout: " + v)
+			}
+		}
+		e := parse(target)
+		err := waitForSSH(e, timeout, nil)
+		if hasFlag(args, "--notify") {
+			if err != nil {
+				notify("ssh-forge", err.Error())
+			} else {
+				notify("ssh-forge", entryKey(e.User, e.Host, e.Port)+" is up")
+			}
+		}
+		if err != nil {
+			die(err.Error())
+		}
+		if !hasFlag(args, "--no-connect") {
+			connect(e)
+		}
+	case "--persist":
+		if len(os.Args) < 3 {
+			die("Usage: ssh-forge --persist target [--retries N] [--tmux name | --screen name]")
+		}
+		retries := 10
+		if v := flagValue(os.Args[3:], "--retries"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				die("Invalid --retries: " + v)
+			}
+			retries = n
+		}
+		attach := ""
+		if name := flagValue(os.Args[3:], "--tmux"); name != "" {
+			attach = "tmux new-session -A -s " + shellQuote(name)
+		} else if name := flagValue(os.Args[3:], "--screen"); name != "" {
+			attach = "screen -D -RR " + shellQuote(name)
+		}
+		persistSession(parse(os.Args[2]), retries, attach)
+	case "--record":
+		if len(os.Args) < 3 {
+			die("Usage: ssh-forge --record target")
+		}
+		recordSession(parse(os.Args[2]))
+	case "--replay":
+		if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+			listRecordings()
+			return
+		}
+		speed := 1.0
+		if v := flagValue(os.Args[3:], "--speed"); v != "" {
+			var err error
+			if speed, err = strconv.ParseFloat(v, 64); err != nil {
+				die("Invalid --speed: " + v)
+			}
+		}
+		var maxIdle time.Duration
+		if v := flagValue(os.Args[3:], "--max-idle"); v != "" {
+			var err error
+			if maxIdle, err = time.ParseDuration(v); err != nil {
+				die("Invalid --max-idle: " + v)
+			}
+		}
+		replay(os.Args[2], speed, maxIdle)
 	case "--doctor":
 		doctor()
 	case "--raw":
 		if len(os.Args) < 3 {
-			die("Usage: ssh-forge --raw user@ip:port")
+			die("Usage: ssh-forge --raw target")
 		}
-		user, host, port := parse(os.Args[2])
-		rawConnect(user, host, port)
+		rawConnect(parse(os.Args[2]))
 	default:
-		user, host, port := parse(os.Args[1])
-		if len(os.Args) > 2 && os.Args[2] == "--remove" {
-			remove(user, host, port)
-		} else {
-			connect(user, host, port)
+		// Everything after "--" is a one-off remote command.
+		var remote []string
+		for i, a := range os.Args[2:] {
+			if a == "--" {
+				remote = os.Args[i+3:]
+				os.Args = os.Args[:i+2]
+				break
+			}
+		}
+		if remote != nil && len(remote) == 0 {
+			die("Usage: ssh-forge target -- command [args]")
+		}
+
+		e := parse(os.Args[1])
+		switch {
+		case len(os.Args) > 2 && os.Args[2] == "--remove":
+			remove(e)
+		case len(os.Args) > 2 && os.Args[2] == "--accept-new-hostkey":
+			acceptHostKey(e)
+		case len(os.Args) > 2 && os.Args[2] == "--tag":
+			if len(os.Args) < 5 {
+				die("Usage: ssh-forge target --tag add|remove tag[,tag]")
+			}
+			editTags(e, os.Args[3], os.Args[4])
+		case len(os.Args) > 2 && os.Args[2] == "--tunnel":
+			var names []string
+			if len(os.Args) > 3 {
+				names = splitList(os.Args[3])
+			}
+			openTunnel(e, names)
+		case len(os.Args) > 2 && os.Args[2] == "--tunnel-add":
+			if len(os.Args) < 5 {
+				die("Usage: ssh-forge name --tunnel-add profile 'L 5432:localhost:5432'")
+			}
+			editTunnel(e, os.Args[3], strings.Join(os.Args[4:], " "))
+		case len(os.Args) > 2 && os.Args[2] == "--tunnel-rm":
+			if len(os.Args) < 4 {
+				die("Usage: ssh-forge name --tunnel-rm profile")
+			}
+			editTunnel(e, os.Args[3], "")
+		default:
+			if alias := flagValue(os.Args[2:], "--alias"); alias != "" {
+				e.Alias = checkAlias(alias)
+			}
+			if id := flagValue(os.Args[2:], "--key"); id != "" {
+				e.Identity = checkIdentity(id)
+			}
+			if v := flagValue(os.Args[2:], "--command"); v != "" {
+				e.Command = v
+			}
+			if v := flagValue(os.Args[2:], "--dir"); v != "" {
+				e.Dir = v
+			}
+			if v := flagValue(os.Args[2:], "--mac"); v != "" {
+				mac, err := checkMAC(v)
+				if err != nil {
+					die(err.Error())
+				}
+				e.MAC = mac
+			}
+			if v := flagValue(os.Args[2:], "--wake-addr"); v != "" {
+				addr, err := checkWakeAddr(v)
+				if err != nil {
+					die("Invalid --wake-addr: " + err.Error())
+				}
+				e.WakeAddr = addr
+			}
+			if v := flagValue(os.Args[2:], "--start-cmd"); v != "" {
+				e.StartCmd = v
+			}
+			if v := flagValue(os.Args[2:], "--stop-cmd"); v != "" {
+				e.StopCmd = v
+			}
+			if hasFlag(os.Args[2:], "--ephemeral") {
+				e.Ephemeral = true
+			}
+			if v := flagValue(os.Args[2:], "--ttl"); v != "" {
+				ttl, err := parseTTL(v)
+				if err != nil {
+					die(err.Error())
+				}
+				e.Ephemeral, e.TTL = true, ttl
+			}
+			if jump := flagValue(os.Args[2:], "--jump"); jump != "" {
+				m := loadCache()
+				e.Jump = nil
+				for _, ref := range splitList(jump) {
+					e.Jump = append(e.Jump, jumpRef(m, ref))
+				}
+				jumpChain(m, e)
+			}
+			if remote != nil {
+				if e, ok := register(e); ok {
+					runRemote(e, remote)
+				}
+				os.Exit(1)
+			}
+			connect(e)
 		}
 	}
 }